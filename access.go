@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+type NewReadKeyReqDTO struct {
+	NewSecret bool // Revoke all previously issued read tokens.
+	Days      int  // How long the token lasts. Defaults to token_period.
+}
+
+// newReadToken returns a token letting its holder download from a private repo, and nothing else.
+func newReadToken(namespace, name, secret string, days int) (string, error) {
+	claims := jwt.MapClaims{
+		"valid":     true,
+		"namespace": namespace,
+		"repo":      name,
+		"exp":       strconv.FormatInt(time.Now().Add(time.Hour*time.Duration(24*days)).Unix(), 10),
+		"type":      "read",
+	}
+	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return tk.SignedString([]byte(secret))
+}
+
+// parseToken checks a JWT's signature, type and expiry, returning its claims.
+func parseToken(raw string, keyfunc jwt.Keyfunc, tokenType string) (jwt.MapClaims, bool) {
+	token, err := jwt.Parse(raw, keyfunc)
+	if err != nil {
+		return nil, false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, false
+	}
+	exp, _ := claims["exp"].(string)
+	expiryUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !time.Unix(expiryUnix, 0).After(time.Now()) {
+		return nil, false
+	}
+	if t, _ := claims["type"].(string); t != tokenType {
+		return nil, false
+	}
+	return claims, true
+}
+
+// bearer returns the decoded token from an "Authorization: Bearer <base64>" header, as sent to both APIs.
+func bearer(gc *gin.Context) string {
+	header := strings.SplitN(gc.Request.Header.Get("Authorization"), "Bearer ", 2)
+	if len(header) < 2 {
+		return ""
+	}
+	auth, _ := base64.StdEncoding.DecodeString(header[1])
+	return string(auth)
+}
+
+// canRead reports whether a request may see a private repo: it's from a logged in admin (by token or the session's refresh cookie),
+// or has a read token for the repo in the Authorization header, ?token= or a preview's path.
+func (app *appContext) canRead(gc *gin.Context, repo Repo) bool {
+	tokens := []string{bearer(gc)}
+	if _, ok := parseToken(tokens[0], jwtWebToken, "bearer"); ok {
+		return true
+	}
+	if cookie, err := gc.Cookie("refresh"); err == nil {
+		if _, ok := parseToken(cookie, jwtWebToken, "refresh"); ok {
+			return true
+		}
+	}
+	if repo.ReadSecret == "" {
+		return false
+	}
+	pathToken, _ := previewPathToken(gc.Param("path"))
+	tokens = append(tokens, gc.Query("token"), pathToken)
+	for _, raw := range tokens {
+		if raw == "" {
+			continue
+		}
+		claims, ok := parseToken(raw, jwtBuildTokenWrapper(repo.ReadSecret), "read")
+		if !ok || claims["namespace"] != repo.Namespace || claims["repo"] != repo.Name {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// readAuth is middleware hiding private repos from those who can't read them. They're answered exactly as if the repo didn't exist.
+func (app *appContext) readAuth() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		namespace := gc.Param("namespace")
+		name := gc.Param("name")
+		repo, ok := app.storage[namespace+"/"+name]
+		if !ok || !repo.Private {
+			return
+		}
+		if _, ok := app.checkLink(gc, repo); !ok && !app.canRead(gc, repo) {
+			abort(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+			return
+		}
+		// Shared caches mustn't keep a copy to give to anyone else.
+		gc.Set("private", true)
+		gc.Header("Cache-Control", "private, no-cache")
+	}
+}
+
+// NewReadKey issues a read token for a repo, for downloading from it while it's private.
+func (app *appContext) NewReadKey(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	var req NewReadKeyReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if req.NewSecret || repo.ReadSecret == "" {
+		log.Printf("%s/%s: Generating new read secret (invalidating previous read tokens)", namespace, name)
+		repo.ReadSecret = shortuuid.New()
+		app.storage[namespace+"/"+name] = repo
+		if err := app.store(); err != nil {
+			end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+			return
+		}
+	}
+	if req.Days <= 0 {
+		req.Days = TOKEN_PERIOD
+	}
+	key, err := newReadToken(namespace, name, repo.ReadSecret, req.Days)
+	if err != nil {
+		end(500, fmt.Sprintf("Couldn't generate token: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s: Generated read key lasting %d days", namespace, name, req.Days)
+	gc.JSON(200, NewKeyRespDTO{Key: key})
+}
+
+// previewToken issues a day-long read token for following a redirect to the preview origin, creating the repo's read secret if needed.
+func (app *appContext) previewToken(namespace, name string) (string, error) {
+	repo := app.storage[namespace+"/"+name]
+	if repo.ReadSecret == "" {
+		repo.ReadSecret = shortuuid.New()
+		app.storage[namespace+"/"+name] = repo
+		if err := app.store(); err != nil {
+			return "", err
+		}
+	}
+	return newReadToken(namespace, name, repo.ReadSecret, 1)
+}
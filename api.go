@@ -2,15 +2,12 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -74,6 +71,10 @@ func (app *appContext) SetTag(gc *gin.Context) {
 		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
 		return
 	}
+	if req.Rollout != nil && (req.Rollout.Percent < 0 || req.Rollout.Percent > 100) {
+		end(400, "Percent must be between 0 and 100", gc)
+		return
+	}
 	var err error
 	repo.Builds, repo.Branches, repo.LatestBuild, repo.LatestNonEmptyBuild, err = app.loadBuilds(repo.Builds, namespace, name)
 	if err != nil {
@@ -96,6 +97,18 @@ func (app *appContext) SetTag(gc *gin.Context) {
 		if req.ReleaseDate != t && req.ReleaseDate != tag.ReleaseDate {
 			tag.ReleaseDate = req.ReleaseDate
 		}
+		if req.MinVersion != "" {
+			tag.MinVersion = req.MinVersion
+		}
+		if req.Rollout != nil {
+			if tag.Rollout != nil && tag.Rollout.Paused {
+				log.Printf("%s/%s: Rollout of tag \"%s\" is paused, ignoring new percentage", namespace, name, tagName)
+			} else if tag.Rollout != nil {
+				tag.Rollout.Percent = req.Rollout.Percent
+			} else {
+				tag.Rollout = &Rollout{Percent: req.Rollout.Percent}
+			}
+		}
 		tag.Ready = req.Ready
 	}
 	if build.Tags == nil {
@@ -103,12 +116,12 @@ func (app *appContext) SetTag(gc *gin.Context) {
 	}
 	build.Tags[tagName] = tag
 	repo.Builds[commit] = build
-	if repo.LatestTags == nil {
-		repo.LatestTags = map[string]Tag{}
-	}
-	repo.LatestTags[tagName] = tag
+	repo.recomputeLatestTag(tagName)
 	app.storage[namespace+"/"+name] = repo
-	app.store()
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
 	end(200, "Tag stored", gc)
 }
 
@@ -124,32 +137,36 @@ func (app *appContext) GetTag(gc *gin.Context) {
 	}
 	var tag Tag
 	if commit == "latest" {
-		tag, ok = repo.LatestTags[tagName]
-		commit = repo.LatestBuild
+		client := gc.Query("client")
+		prerelease := gc.DefaultQuery("prerelease", "true") != "false"
+		// Resolved by highest version rather than whichever was set last, so an old branch re-running can't go backwards.
+		var e tagEntry
+		e, ok = repo.latestTag(tagName, prerelease, client)
+		tag = e.tag
+		if !ok {
+			// Builds dropped from Drone's build list lose their tags, but the last one set is still kept.
+			// Anything in repo.Builds was already considered by latestTag, so it isn't looked up again.
+			tag, ok = repo.LatestTags[tagName]
+			ok = ok && tag.servedTo(tagName, client)
+			if v, _ := parseSemver(tag.Version); !prerelease && v.prerelease() {
+				ok = false
+			}
+		}
 	} else {
-		ok = false
-	}
-	if !ok {
-		build, ok := repo.Builds[commit]
+		var build Build
+		build, ok = repo.Builds[commit]
 		if !ok {
 			end(400, "Couldn't get build", gc)
 			return
 		}
 		tag, ok = build.Tags[tagName]
+		ok = ok && !build.Yanked
 	}
 	if !ok || !tag.Ready {
 		tag = Tag{}
 	}
 	gc.JSON(200, tag)
-	go app.logIP(gc.ClientIP())
-}
-
-func (app *appContext) logIP(ip string) {
-	if !LOGIPS {
-		return
-	}
-	http.Get(app.logTo + ip)
-
+	app.recordTagCheck(gc, namespace, name, tagName)
 }
 
 func (app *appContext) addFiles(gc *gin.Context) {
@@ -157,6 +174,11 @@ func (app *appContext) addFiles(gc *gin.Context) {
 	name := gc.Param("name")
 	commit := gc.Param("commit")
 
+	if !enoughSpace(gc.Request.ContentLength) {
+		end(507, "Not enough free disk space", gc)
+		log.Printf("%s/%s: Refused upload, not enough free disk space", ns, name)
+		return
+	}
 	form, err := gc.MultipartForm()
 	if err != nil {
 		end(400, fmt.Sprintf("Form error: %s", err), gc)
@@ -198,19 +220,52 @@ func (app *appContext) addFiles(gc *gin.Context) {
 		return
 	}
 	build := repo.Builds[commit]
+	extract := gc.Query("extract") == "true"
+	keep := gc.Query("keep") == "true"
+	fnames := []string{}
 	for fname, file := range files {
-		buildFolder := filepath.Join(STORAGE, commitDirectory, fname)
+		rel, err := safeRelPath(fname)
+		if err != nil {
+			end(400, err.Error(), gc)
+			return
+		}
+		buildFolder := filepath.Join(STORAGE, commitDirectory, rel)
+		if extract && isArchive(fname) {
+			names, err := extractUpload(gc, file[0], filepath.Join(STORAGE, commitDirectory), rel, keep)
+			if err != nil {
+				end(400, fmt.Sprintf("Couldn't extract %s: %s", fname, err), gc)
+				log.Printf("%s/%s (%s): Couldn't extract %s: %s", ns, name, commit, fname, err)
+				return
+			}
+			log.Printf("%s/%s (%s): Extracted %d files from %s\n", ns, name, commit, len(names), fname)
+			fnames = append(fnames, names...)
+			continue
+		}
 		log.Printf("%s/%s (%s): Saving to %s\n", ns, name, commit, buildFolder)
+		os.MkdirAll(filepath.Dir(buildFolder), os.FileMode(DIRPERM))
+		removeVariants(buildFolder)
 		if err := gc.SaveUploadedFile(file[0], buildFolder); err != nil {
+			os.Remove(buildFolder)
 			end(500, fmt.Sprintf("Couldn't store file: %s", err), gc)
 			return
 		}
+		fnames = append(fnames, filepath.ToSlash(rel))
 	}
 	build.DateChanged = time.Now()
 	build.Files = commitDirectory
+	build.countSize()
 	repo.Builds[commit] = build
 	app.storage[ns+"/"+name] = repo
-	app.store()
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	if repo.Precompress {
+		go func() {
+			precompress(filepath.Join(STORAGE, commitDirectory), fnames)
+			app.recounts.add(commitDirectory)
+		}()
+	}
 	gc.AbortWithStatus(200)
 }
 
@@ -226,6 +281,8 @@ func (app *appContext) getRepos(gc *gin.Context) {
 			Namespace: repo.Namespace,
 			Name:      repo.Name,
 			Secret:    (repo.Secret != ""),
+			Private:   repo.Private,
+			Size:      repo.Size(),
 		}
 		newestCommit := ""
 		newestTime := time.Time{}
@@ -260,6 +317,25 @@ func (sb SortableBuilds) Less(i, j int) bool {
 	return a.Date.After(b.Date)
 }
 
+// buildDTO fills the BuildDTO fields that come straight from a Build.
+func buildDTO(b Build) BuildDTO {
+	notesHTML := ""
+	if b.Notes != "" {
+		notesHTML = renderMarkdown(b.Notes)
+	}
+	return BuildDTO{
+		ID:         b.ID,
+		Name:       b.Name,
+		Message:    b.Message,
+		Link:       b.Link,
+		Date:       b.Date,
+		Branch:     b.Branch,
+		Yanked:     b.Yanked,
+		YankReason: b.YankReason,
+		Notes:      notesHTML,
+	}
+}
+
 type BuildsDTO struct {
 	Order  []string
 	Builds map[string]BuildDTO
@@ -279,13 +355,7 @@ func (app *appContext) getBuild(gc *gin.Context) {
 		end(400, "Build not found", gc)
 		return
 	}
-	gc.JSON(200, BuildDTO{
-		ID:     build.ID,
-		Name:   build.Name,
-		Link:   build.Link,
-		Date:   build.Date,
-		Branch: build.Branch,
-	})
+	gc.JSON(200, buildDTO(build))
 }
 
 func (app *appContext) getBuilds(gc *gin.Context) {
@@ -311,15 +381,12 @@ func (app *appContext) getBuilds(gc *gin.Context) {
 	sb.builds = map[string]BuildDTO{}
 	i := 0
 	for c, b := range repo.Builds {
-		dto := BuildDTO{
-			ID:     b.ID,
-			Name:   b.Name,
-			Link:   b.Link,
-			Date:   b.Date,
-			Branch: b.Branch,
+		dto := buildDTO(b)
+		if hasPreview(b) {
+			dto.Preview = previewURL(gc, namespace, name, c)
 		}
 		if b.Files != "" {
-			files, err := ioutil.ReadDir(filepath.Join(STORAGE, b.Files))
+			files, err := listBuildFiles(b)
 			if err != nil {
 				log.Printf("%s/%s: Error reading \"%s\": %s\n", namespace, name, b.Files, err)
 				continue
@@ -327,8 +394,8 @@ func (app *appContext) getBuilds(gc *gin.Context) {
 			dto.Files = make([]FileDTO, len(files))
 			for i, f := range files {
 				dto.Files[i] = FileDTO{
-					Name: f.Name(),
-					Size: fileSize(f.Size()),
+					Name: f.Name,
+					Size: fileSize(f.Size),
 				}
 			}
 		}
@@ -367,6 +434,7 @@ func (app *appContext) getRepo(gc *gin.Context) {
 		Name:           name,
 		BuildPageCount: roundPageCount(uint(len(repo.Builds))),
 		Branches:       repo.Branches,
+		Channels:       repo.Channels,
 	}
 	gc.JSON(200, resp)
 }
@@ -379,24 +447,18 @@ func (app *appContext) LatestCommit(gc *gin.Context) {
 		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
 		return
 	}
-	build, ok := repo.Builds[repo.LatestNonEmptyBuild]
+	_, build, ok := repo.latestBuild(gc.Param("branch"))
 	if !ok {
-		end(500, "Couldn't find latest build", gc)
+		end(404, "Couldn't find latest build", gc)
 		return
 	}
-	gc.JSON(200, BuildDTO{
-		ID:     build.ID,
-		Name:   build.Name,
-		Link:   build.Link,
-		Date:   build.Date,
-		Branch: build.Branch,
-	})
+	gc.JSON(200, buildDTO(build))
 }
 
 func (app *appContext) findLatest(gc *gin.Context) {
 	namespace := gc.Param("namespace")
 	name := gc.Param("name")
-	search := strings.ToLower(gc.Param("search"))
+	search := gc.Param("search")
 	if search == "" {
 		end(400, "No file name/query provided", gc)
 		return
@@ -406,24 +468,12 @@ func (app *appContext) findLatest(gc *gin.Context) {
 		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
 		return
 	}
-	build, ok := repo.Builds[repo.LatestNonEmptyBuild]
+	commit, build, ok := repo.latestBuild(gc.Param("branch"))
 	if !ok {
-		end(500, "Couldn't find latest build", gc)
+		end(404, "Couldn't find latest build", gc)
 		return
 	}
-	files, err := os.ReadDir(filepath.Join(STORAGE, build.Files))
-	if err != nil {
-		end(500, "Couldn't read directory", gc)
-		return
-	}
-	for _, file := range files {
-		if strings.Contains(strings.ToLower(file.Name()), search) {
-			gc.FileAttachment(filepath.Join(STORAGE, build.Files, file.Name()), file.Name())
-			return
-		}
-	}
-	end(500, "No matching file found", gc)
-	app.logIP(gc.ClientIP())
+	app.serveMatch(gc, namespace, name, commit, build, search)
 }
 
 func (app *appContext) getFile(gc *gin.Context) {
@@ -441,11 +491,19 @@ func (app *appContext) getFile(gc *gin.Context) {
 		end(400, "Build not found", gc)
 		return
 	}
-	path := filepath.Join(build.Files, fname)
-	if _, err := os.Stat(filepath.Join(STORAGE, path)); os.IsNotExist(err) {
-		end(400, fmt.Sprintf("File not found: %s", path), gc)
+	if path, ok := buildFilePath(build, fname); !ok {
+		end(400, fmt.Sprintf("Invalid file name: %s", fname), gc)
+		return
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		end(400, fmt.Sprintf("File not found: %s", filepath.Join(build.Files, fname)), gc)
+		return
+	}
+	if !allowYankedDownload(gc, build) {
+		return
+	}
+	if !app.useLink(gc, namespace, name) {
 		return
 	}
-	gc.FileFromFS(path, app.fs)
-	app.logIP(gc.ClientIP())
+	app.serveBuildFile(gc, build, fname)
+	app.recordDownload(gc, namespace, name, buildname, fname)
 }
@@ -0,0 +1,29 @@
+package main
+
+import "sort"
+
+// latestBuild returns the newest build with files on the given branch, or the repo's default branch if blank, and its commit.
+// With neither, it's the newest across all branches.
+func (repo Repo) latestBuild(branch string) (commit string, build Build, ok bool) {
+	if branch == "" {
+		branch = repo.DefaultBranch
+	}
+	if branch == "" {
+		commit = repo.LatestNonEmptyBuild
+		build, ok = repo.Builds[commit]
+		return
+	}
+	commits := []string{}
+	for c, b := range repo.Builds {
+		if b.Branch == branch && b.Files != "" && !b.Yanked {
+			commits = append(commits, c)
+		}
+	}
+	sort.Slice(commits, func(i, j int) bool { return repo.Builds[commits[i]].Date.After(repo.Builds[commits[j]].Date) })
+	for _, c := range commits {
+		if buildHasFiles(repo.Builds[c]) {
+			return c, repo.Builds[c], true
+		}
+	}
+	return
+}
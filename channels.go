@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PromoteReqDTO struct {
+	Commit string
+}
+
+// promote points a repo's channel at a commit.
+func (app *appContext) promote(namespace, name, channel, commit string) (status int, err error) {
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		return 400, fmt.Errorf("Repository not found: %s/%s", namespace, name)
+	}
+	if channel == "" {
+		return 400, fmt.Errorf("No channel provided")
+	}
+	if b, ok := repo.Builds[commit]; !ok {
+		return 400, fmt.Errorf("Commit not found: %s", commit)
+	} else if b.Yanked {
+		return 400, fmt.Errorf("Commit has been yanked: %s", commit)
+	}
+	if repo.Channels == nil {
+		repo.Channels = map[string]string{}
+	}
+	log.Printf("%s/%s: Promoting %s to channel \"%s\"", namespace, name, commit, channel)
+	repo.Channels[channel] = commit
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		return 500, fmt.Errorf("Couldn't store data: %s", err)
+	}
+	return 200, nil
+}
+
+// PromoteBuild is the build API's /commit/:commit/promote/:channel.
+func (app *appContext) PromoteBuild(gc *gin.Context) {
+	status, err := app.promote(gc.Param("namespace"), gc.Param("name"), gc.Param("tag"), gc.Param("commit"))
+	if err != nil {
+		end(status, err.Error(), gc)
+		return
+	}
+	end(200, "Build promoted", gc)
+}
+
+func (app *appContext) SetChannel(gc *gin.Context) {
+	var req PromoteReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	status, err := app.promote(gc.Param("namespace"), gc.Param("name"), gc.Param("channel"), req.Commit)
+	if err != nil {
+		end(status, err.Error(), gc)
+		return
+	}
+	end(200, "Build promoted", gc)
+}
+
+func (app *appContext) DeleteChannel(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	channel := gc.Param("channel")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if _, ok := repo.Channels[channel]; !ok {
+		end(404, fmt.Sprintf("Channel not found: %s", channel), gc)
+		return
+	}
+	delete(repo.Channels, channel)
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	end(200, "Channel deleted", gc)
+}
+
+// channelBuild returns the build a channel points at, and its commit.
+func (app *appContext) channelBuild(gc *gin.Context) (commit string, build Build, ok bool) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	channel := gc.Param("channel")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	commit, ok = repo.Channels[channel]
+	if !ok {
+		end(404, fmt.Sprintf("Channel not found: %s", channel), gc)
+		return
+	}
+	build, ok = repo.Builds[commit]
+	if !ok {
+		end(500, "Couldn't find channel's build", gc)
+		return
+	}
+	if build.Yanked {
+		end(410, fmt.Sprintf("Channel's build has been yanked: %s", build.YankReason), gc)
+		return commit, build, false
+	}
+	return
+}
+
+// channelEntry returns the build a channel points at, versioned by the build's newest ready tag with a version, or its commit if it has none.
+// Rollouts aren't applied, as a channel is set by hand.
+func (repo Repo) channelEntry(channel string) (tagEntry, bool) {
+	commit, ok := repo.Channels[channel]
+	if !ok {
+		return tagEntry{}, false
+	}
+	build, ok := repo.Builds[commit]
+	if !ok || build.Yanked {
+		return tagEntry{}, false
+	}
+	e := tagEntry{commit: commit, build: build, tag: Tag{Ready: true, Version: commit}}
+	found := false
+	for _, t := range build.Tags {
+		if t.Ready && t.Version != "" && (!found || t.ReleaseDate.After(e.tag.ReleaseDate.Time)) {
+			e.tag, found = t, true
+		}
+	}
+	e.tag.Rollout = nil
+	if e.tag.ReleaseDate.IsZero() {
+		e.tag.ReleaseDate = Time{build.Date}
+	}
+	e.semver, e.isSemver = parseSemver(e.tag.Version)
+	return e, true
+}
+
+// ChannelCommit is LatestCommit for a channel.
+func (app *appContext) ChannelCommit(gc *gin.Context) {
+	_, build, ok := app.channelBuild(gc)
+	if !ok {
+		return
+	}
+	gc.JSON(200, buildDTO(build))
+}
+
+// findChannel is findLatest for a channel.
+func (app *appContext) findChannel(gc *gin.Context) {
+	search := gc.Param("search")
+	if search == "" {
+		end(400, "No file name/query provided", gc)
+		return
+	}
+	commit, build, ok := app.channelBuild(gc)
+	if !ok {
+		return
+	}
+	app.serveMatch(gc, gc.Param("namespace"), gc.Param("name"), commit, build, search)
+}
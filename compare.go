@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveRef finds the build a compare endpoint refers to. A ref is a commit (or a unique prefix of one, as shown on the repo page),
+// "<tag>:<version>" for a specific version of a tag, or "<tag>" for its latest ready version.
+func (repo Repo) resolveRef(ref string) (commit string, build Build, err error) {
+	if b, ok := repo.Builds[ref]; ok {
+		return ref, b, nil
+	}
+	if tagName, version, ok := strings.Cut(ref, ":"); ok {
+		for _, e := range repo.tagHistory(tagName) {
+			if e.tag.Version == version {
+				return e.commit, e.build, nil
+			}
+		}
+		return "", Build{}, fmt.Errorf("Version \"%s\" of tag \"%s\" not found", version, tagName)
+	}
+	if e, ok := repo.latestTag(ref, true, ""); ok {
+		return e.commit, e.build, nil
+	}
+	if len(ref) >= 4 {
+		for c, b := range repo.Builds {
+			if !strings.HasPrefix(c, ref) {
+				continue
+			}
+			if commit != "" {
+				return "", Build{}, fmt.Errorf("Ambiguous commit: %s", ref)
+			}
+			commit, build = c, b
+		}
+		if commit != "" {
+			return commit, build, nil
+		}
+	}
+	return "", Build{}, fmt.Errorf("Commit or tag not found: %s", ref)
+}
+
+type CompareDTO struct {
+	From   string
+	To     string
+	Branch string            // Set if both builds are on the same branch, in which case only builds on it are listed.
+	Builds []CompareBuildDTO // Builds after From, up to and including To, newest first.
+	Files  FileDiffDTO
+}
+
+type CompareBuildDTO struct {
+	Commit  string
+	Name    string
+	Message string
+	Date    time.Time
+	Branch  string
+	Link    string
+	Tags    []string // "<tag> <version>"
+	Yanked  bool
+}
+
+type FileDiffDTO struct {
+	Added   []FileChangeDTO
+	Removed []FileChangeDTO
+	Changed []FileChangeDTO // Files in both builds with a different size.
+}
+
+type FileChangeDTO struct {
+	Name    string
+	OldSize int64 `json:",omitempty"`
+	NewSize int64 `json:",omitempty"`
+}
+
+// buildFileSizes returns the size of each file in a build.
+func buildFileSizes(build Build) map[string]int64 {
+	sizes := map[string]int64{}
+	files, _ := listBuildFiles(build)
+	for _, f := range files {
+		sizes[f.Name] = f.Size
+	}
+	return sizes
+}
+
+// diffFiles compares the artifacts of two builds.
+func diffFiles(from, to Build) (diff FileDiffDTO) {
+	oldSizes, newSizes := buildFileSizes(from), buildFileSizes(to)
+	diff.Added, diff.Removed, diff.Changed = []FileChangeDTO{}, []FileChangeDTO{}, []FileChangeDTO{}
+	for name, size := range newSizes {
+		if oldSize, ok := oldSizes[name]; !ok {
+			diff.Added = append(diff.Added, FileChangeDTO{Name: name, NewSize: size})
+		} else if oldSize != size {
+			diff.Changed = append(diff.Changed, FileChangeDTO{Name: name, OldSize: oldSize, NewSize: size})
+		}
+	}
+	for name, size := range oldSizes {
+		if _, ok := newSizes[name]; !ok {
+			diff.Removed = append(diff.Removed, FileChangeDTO{Name: name, OldSize: size})
+		}
+	}
+	for _, l := range [][]FileChangeDTO{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	}
+	return
+}
+
+// Compare lists the builds between two commits or tags (see resolveRef) and the difference in their files.
+// If "from" is newer than "to", they're swapped. ?format=markdown or ?format=text renders it as a changelog.
+func (app *appContext) Compare(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	fromCommit, from, err := repo.resolveRef(gc.Param("from"))
+	if err != nil {
+		end(404, err.Error(), gc)
+		return
+	}
+	toCommit, to, err := repo.resolveRef(gc.Param("to"))
+	if err != nil {
+		end(404, err.Error(), gc)
+		return
+	}
+	if to.Date.Before(from.Date) {
+		fromCommit, from, toCommit, to = toCommit, to, fromCommit, from
+	}
+	resp := CompareDTO{
+		From:   fromCommit,
+		To:     toCommit,
+		Builds: []CompareBuildDTO{},
+		Files:  diffFiles(from, to),
+	}
+	if from.Branch == to.Branch {
+		resp.Branch = to.Branch
+	}
+	for commit, b := range repo.Builds {
+		if commit == fromCommit || !b.Date.After(from.Date) || b.Date.After(to.Date) {
+			continue
+		}
+		if resp.Branch != "" && b.Branch != resp.Branch {
+			continue
+		}
+		cb := CompareBuildDTO{
+			Commit:  commit,
+			Name:    b.Name,
+			Message: b.Message,
+			Date:    b.Date,
+			Branch:  b.Branch,
+			Link:    b.Link,
+			Tags:    []string{},
+			Yanked:  b.Yanked,
+		}
+		for tagName, tag := range b.Tags {
+			cb.Tags = append(cb.Tags, tagName+" "+tag.Version)
+		}
+		sort.Strings(cb.Tags)
+		resp.Builds = append(resp.Builds, cb)
+	}
+	sort.Slice(resp.Builds, func(i, j int) bool { return resp.Builds[i].Date.After(resp.Builds[j].Date) })
+	switch gc.Query("format") {
+	case "markdown":
+		gc.Data(200, "text/markdown; charset=utf-8", []byte(resp.render(true)))
+	case "text":
+		gc.Data(200, "text/plain; charset=utf-8", []byte(resp.render(false)))
+	default:
+		gc.JSON(200, resp)
+	}
+}
+
+// render writes a changelog as Markdown, or plain text.
+func (c CompareDTO) render(markdown bool) string {
+	var out strings.Builder
+	short := func(commit string) string {
+		if len(commit) > 7 {
+			return commit[:7]
+		}
+		return commit
+	}
+	heading := func(s string) {
+		if markdown {
+			out.WriteString("## " + s + "\n\n")
+		} else {
+			out.WriteString(s + "\n" + strings.Repeat("=", len(s)) + "\n\n")
+		}
+	}
+	title := fmt.Sprintf("Changes from %s to %s", short(c.From), short(c.To))
+	if c.Branch != "" {
+		title += " on " + c.Branch
+	}
+	if markdown {
+		out.WriteString("# " + title + "\n\n")
+	} else {
+		out.WriteString(title + "\n\n")
+	}
+	heading("Commits")
+	if len(c.Builds) == 0 {
+		out.WriteString("No builds.\n")
+	}
+	for _, b := range c.Builds {
+		commit := short(b.Commit)
+		if markdown {
+			commit = "`" + commit + "`"
+			if b.Link != "" {
+				commit = "[" + commit + "](" + b.Link + ")"
+			}
+		}
+		line := fmt.Sprintf("- %s %s (%s)", commit, b.Name, b.Date.Format("2006-01-02"))
+		if len(b.Tags) != 0 {
+			line += " [" + strings.Join(b.Tags, ", ") + "]"
+		}
+		if b.Yanked {
+			line += " (yanked)"
+		}
+		out.WriteString(line + "\n")
+		// The rest of the commit message, indented under its summary.
+		if _, body, ok := strings.Cut(b.Message, "\n"); ok {
+			for _, l := range strings.Split(strings.TrimSpace(body), "\n") {
+				out.WriteString(strings.TrimRight("  "+l, " ") + "\n")
+			}
+		}
+	}
+	out.WriteString("\n")
+	heading("Files")
+	if len(c.Files.Added)+len(c.Files.Removed)+len(c.Files.Changed) == 0 {
+		out.WriteString("No changes.\n")
+	}
+	code := func(s string) string {
+		if markdown {
+			return "`" + s + "`"
+		}
+		return s
+	}
+	for _, f := range c.Files.Added {
+		out.WriteString(fmt.Sprintf("- Added %s (%s)\n", code(f.Name), fileSize(f.NewSize)))
+	}
+	for _, f := range c.Files.Removed {
+		out.WriteString(fmt.Sprintf("- Removed %s\n", code(f.Name)))
+	}
+	for _, f := range c.Files.Changed {
+		out.WriteString(fmt.Sprintf("- Changed %s (%s -> %s)\n", code(f.Name), fileSize(f.OldSize), fileSize(f.NewSize)))
+	}
+	return out.String()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// precompressedDir is the directory inside a build's folder holding compressed copies of its files, e.g. .precompressed/app.wasm.zst.
+const precompressedDir = ".precompressed"
+
+// MINPRECOMPRESS is the smallest file worth compressing, in bytes.
+const MINPRECOMPRESS = 1024
+
+type encoding struct {
+	name   string // As in Accept-Encoding/Content-Encoding.
+	suffix string
+	writer func(w io.Writer) (io.WriteCloser, error)
+}
+
+// encodings are the precompressed variants made of each file, most preferred first.
+var encodings = []encoding{
+	{"zstd", ".zst", func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	}},
+	{"gzip", ".gz", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, gzip.BestCompression) }},
+}
+
+// incompressible lists extensions of files that are already compressed, so aren't worth compressing again.
+var incompressible = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true, ".br": true, ".lz": true, ".lzma": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true, ".aab": true, ".appx": true, ".msix": true,
+	".dmg": true, ".deb": true, ".rpm": true, ".snap": true, ".flatpak": true, ".appimage": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".ogg": true, ".opus": true, ".woff": true, ".woff2": true,
+}
+
+func variantPath(path string, enc encoding) string {
+	return filepath.Join(filepath.Dir(path), precompressedDir, filepath.Base(path)+enc.suffix)
+}
+
+// removeVariants deletes the compressed copies of a file, so a replaced file isn't served stale.
+func removeVariants(path string) {
+	for _, enc := range encodings {
+		os.Remove(variantPath(path, enc))
+	}
+}
+
+// precompress writes each encoding of the given files in a build's folder, keeping those that save at least a tenth of the size.
+// It's slow, so it's run in the background after an upload.
+func precompress(dir string, fnames []string) {
+	for _, fname := range fnames {
+		path := filepath.Join(dir, fname)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Size() < MINPRECOMPRESS || incompressible[strings.ToLower(filepath.Ext(fname))] {
+			continue
+		}
+		// Variants sit next to their file, which may be in a subfolder.
+		variantDir := filepath.Dir(variantPath(path, encodings[0]))
+		if err := os.MkdirAll(variantDir, os.FileMode(DIRPERM)); err != nil {
+			log.Printf("Couldn't create \"%s\": %s", variantDir, err)
+			continue
+		}
+		for _, enc := range encodings {
+			size, err := compressFile(path, variantPath(path, enc), enc)
+			if err != nil {
+				log.Printf("Couldn't compress \"%s\" with %s: %s", path, enc.name, err)
+				continue
+			}
+			if size > info.Size()*9/10 {
+				os.Remove(variantPath(path, enc))
+			}
+		}
+	}
+}
+
+// compressFile writes src compressed to dst, via a temporary file so a partial variant is never served.
+func compressFile(src, dst string, enc encoding) (size int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w, err := enc.writer(tmp)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	if _, err = io.Copy(w, in); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return info.Size(), os.Rename(tmp.Name(), dst)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the given coding, following its q-values and "*".
+func acceptsEncoding(header, coding string) bool {
+	accepted, wildcard := false, false
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(strings.TrimPrefix(v, "q="), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if name == coding {
+			// An explicit entry overrides the wildcard.
+			return q > 0
+		}
+		wildcard = true
+		accepted = q > 0
+	}
+	return wildcard && accepted
+}
+
+// precompressedVariant returns the most preferred up-to-date variant of a file the client accepts, if any.
+// hasVariants reports whether there are any, in which case responses vary on Accept-Encoding.
+func precompressedVariant(path string, original os.FileInfo, acceptEncoding string) (variant string, enc encoding, hasVariants bool) {
+	for _, e := range encodings {
+		info, err := os.Stat(variantPath(path, e))
+		if err != nil || info.ModTime().Before(original.ModTime()) {
+			continue
+		}
+		hasVariants = true
+		if variant == "" && acceptsEncoding(acceptEncoding, e.name) {
+			variant, enc = variantPath(path, e), e
+		}
+	}
+	return
+}
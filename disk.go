@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import "syscall"
+
+// diskSpace returns the free and total bytes on the filesystem containing path.
+// Field types differ between systems (int64 on FreeBSD), hence the conversions.
+func diskSpace(path string) (free, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return
+	}
+	free = uint64(stat.Bavail) * uint64(stat.Bsize)
+	total = uint64(stat.Blocks) * uint64(stat.Bsize)
+	return
+}
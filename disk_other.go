@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// diskSpace isn't implemented on other systems (including Windows), so min_free_space is ignored there.
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormat   = 1
+	exportManifest = "manifest.json"
+	exportFiles    = "files/"
+)
+
+// ExportManifest is the first entry of an export archive, describing everything else in it. Build files follow under files/<Build.Files>/.
+type ExportManifest struct {
+	Format  int
+	Created time.Time
+	Secrets bool            // Whether repo secrets were included. If not, keys, read tokens and signed links must be reissued after import.
+	Repos   map[string]Repo // map["namespace/name"]Repo
+}
+
+// namespaceMap is a repeatable -map old=new flag.
+type namespaceMap map[string]string
+
+func (m namespaceMap) String() string {
+	pairs := []string{}
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m namespaceMap) Set(s string) error {
+	pair := strings.SplitN(s, "=", 2)
+	if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+		return fmt.Errorf("expected old=new, got \"%s\"", s)
+	}
+	m[pair[0]] = pair[1]
+	return nil
+}
+
+func (m namespaceMap) get(ns string) string {
+	if n, ok := m[ns]; ok {
+		return n
+	}
+	return ns
+}
+
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&DATADIR, "data", DATADIR, "location of stored database and build files")
+	out := fs.String("o", "buildrone-export.tar.gz", "file to write the export to")
+	noSecrets := fs.Bool("no-secrets", false, "exclude repo secrets (build keys, read tokens and signed links will need reissuing)")
+	fs.Parse(args)
+	STORAGE = filepath.Join(DATADIR, "buildfiles")
+
+	app := &appContext{storage: map[string]Repo{}}
+	if err := app.read(); err != nil {
+		log.Fatalf("Failed to read storage: %s", err)
+	}
+	if err := app.export(*out, !*noSecrets); err != nil {
+		os.Remove(*out)
+		log.Fatalf("Failed to export: %s", err)
+	}
+	log.Printf("Exported %d repos to \"%s\"", len(app.storage), *out)
+}
+
+func (app *appContext) export(dst string, secrets bool) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest := ExportManifest{
+		Format:  exportFormat,
+		Created: time.Now(),
+		Secrets: secrets,
+		Repos:   map[string]Repo{},
+	}
+	for id, repo := range app.storage {
+		if !secrets {
+			// Any of these would let the archive's holder upload builds, read private repos or sign download links.
+			repo.Secret = ""
+			repo.ReadSecret = ""
+			repo.LinkSecret = ""
+			repo.Links = nil
+		}
+		manifest.Repos[id] = repo
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    exportManifest,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: manifest.Created,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, repo := range app.storage {
+		for commit, build := range repo.Builds {
+			if build.Files == "" {
+				continue
+			}
+			dir := filepath.Join(STORAGE, build.Files)
+			files, err := listBuildFiles(build)
+			if err != nil {
+				log.Printf("%s/%s (%s): Skipping files: %s", repo.Namespace, repo.Name, commit, err)
+				continue
+			}
+			extra, err := hiddenFiles(dir)
+			if err != nil {
+				log.Printf("%s/%s (%s): Skipping preview and precompressed files: %s", repo.Namespace, repo.Name, commit, err)
+			}
+			for _, name := range append(fileNames(files), extra...) {
+				if err := addToTar(tw, filepath.Join(dir, filepath.FromSlash(name)), exportFiles+filepath.ToSlash(build.Files)+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func fileNames(files []buildFile) []string {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return names
+}
+
+// hiddenFiles lists the files of a build's preview site and precompressed copies, which listBuildFiles leaves out,
+// relative to the build's folder. Unfinished uploads are skipped.
+func hiddenFiles(dir string) ([]string, error) {
+	names := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), uploadTmpPrefix) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, siteDir+"/") || strings.Contains("/"+rel, "/"+precompressedDir+"/") {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// importRelPath is safeRelPath for a file in an export, which may also be in a build's preview or precompressed copies.
+func importRelPath(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if (i == 0 && part == siteDir) || (i < len(parts)-1 && part == precompressedDir) {
+			continue
+		}
+		if rel, err := safeRelPath(part); err != nil || rel != part {
+			return "", fmt.Errorf("Invalid path: %s", name)
+		}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// checkImportName refuses a namespace, repo name or commit from an archive that isn't a single ordinary path component,
+// as they're used to name build folders.
+func checkImportName(s string) error {
+	if rel, err := safeRelPath(s); err != nil || rel != s {
+		return fmt.Errorf("invalid name \"%s\"", s)
+	}
+	return nil
+}
+
+func addToTar(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&DATADIR, "data", DATADIR, "location of stored database and build files")
+	nsMap := namespaceMap{}
+	fs.Var(nsMap, "map", "rename a namespace on import, as old=new. Can be given multiple times.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: buildrone import [options] <export.tar.gz>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	STORAGE = filepath.Join(DATADIR, "buildfiles")
+	if err := os.MkdirAll(STORAGE, os.FileMode(DIRPERM)); err != nil {
+		log.Fatalf("Failed to create data directory: %s", err)
+	}
+
+	app := &appContext{storage: map[string]Repo{}}
+	if err := app.read(); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to read storage: %s", err)
+	}
+	if err := app.importArchive(fs.Arg(0), nsMap); err != nil {
+		log.Fatalf("Failed to import: %s", err)
+	}
+	if err := app.store(); err != nil {
+		log.Fatalf("Failed to store data: %s", err)
+	}
+	log.Printf("Imported \"%s\" into \"%s\"", fs.Arg(0), DATADIR)
+}
+
+// importArchive merges an export into storage. Existing repos, builds and tags are kept, and only missing ones are added.
+func (app *appContext) importArchive(src string, nsMap namespaceMap) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != exportManifest {
+		return fmt.Errorf("not a buildrone export: first entry is \"%s\"", hdr.Name)
+	}
+	var manifest ExportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("couldn't read manifest: %w", err)
+	}
+	if manifest.Format > exportFormat {
+		return fmt.Errorf("export format %d is newer than supported (%d)", manifest.Format, exportFormat)
+	}
+	if !manifest.Secrets {
+		log.Printf("Export contains no secrets, build keys, read tokens and signed links will need reissuing for new repos")
+	}
+
+	// dirs maps a build's directory in the archive to its new one under STORAGE.
+	dirs := map[string]string{}
+	for _, repo := range manifest.Repos {
+		ns := nsMap.get(repo.Namespace)
+		for _, s := range []string{ns, repo.Name} {
+			if err := checkImportName(s); err != nil {
+				return err
+			}
+		}
+		id := ns + "/" + repo.Name
+		existing, ok := app.storage[id]
+		if !ok {
+			existing = repo
+			existing.Namespace = ns
+			existing.Builds = nil
+			existing.LatestTags = nil
+		}
+		if existing.Builds == nil {
+			existing.Builds = map[string]Build{}
+		}
+		if existing.LatestTags == nil {
+			existing.LatestTags = map[string]Tag{}
+		}
+		if existing.Secret == "" {
+			existing.Secret = repo.Secret
+		}
+		if existing.ReadSecret == "" {
+			existing.ReadSecret = repo.ReadSecret
+		}
+		// Links are signed with the archive's link secret, so they're only kept if that's the secret used here.
+		if existing.LinkSecret == "" {
+			existing.LinkSecret = repo.LinkSecret
+		}
+		if existing.LinkSecret == repo.LinkSecret && len(repo.Links) != 0 {
+			if existing.Links == nil {
+				existing.Links = map[string]SignedLink{}
+			}
+			for linkID, link := range repo.Links {
+				if _, ok := existing.Links[linkID]; !ok {
+					existing.Links[linkID] = link
+				}
+			}
+		} else if len(repo.Links) != 0 {
+			log.Printf("%s: Skipping %d signed links, as the repo already has a different link secret", id, len(repo.Links))
+		}
+		for commit, build := range repo.Builds {
+			if _, ok := existing.Builds[commit]; ok {
+				continue
+			}
+			if err := checkImportName(commit); err != nil {
+				return err
+			}
+			if build.Files != "" {
+				newDir := filepath.Join(ns, repo.Name, commit)
+				dirs[filepath.ToSlash(build.Files)] = newDir
+				build.Files = newDir
+			}
+			existing.Builds[commit] = build
+		}
+		for name, tag := range repo.LatestTags {
+			if _, ok := existing.LatestTags[name]; !ok {
+				existing.LatestTags[name] = tag
+			}
+		}
+		app.storage[id] = existing
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, exportFiles) {
+			continue
+		}
+		// Files unpacked from archives can be in subdirectories of the build's, so its folder is found by prefix.
+		name := strings.TrimPrefix(hdr.Name, exportFiles)
+		dst := ""
+		for oldDir, newDir := range dirs {
+			if !strings.HasPrefix(name, oldDir+"/") {
+				continue
+			}
+			if rel, err := importRelPath(strings.TrimPrefix(name, oldDir+"/")); err == nil {
+				dst = filepath.Join(STORAGE, newDir, rel)
+			}
+			break
+		}
+		if dst == "" {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(DIRPERM)); err != nil {
+			return err
+		}
+		if err := writeFrom(tr, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFrom(r io.Reader, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	EXTRACT_MAX_SIZE  int64 = 1 << 30 // Most bytes unpacked from one archive.
+	EXTRACT_MAX_FILES       = 10000   // Most files unpacked from one archive.
+)
+
+// uploadTmpPrefix names temporary directories in a build's folder that uploads are unpacked into before being moved into place.
+const uploadTmpPrefix = ".upload-"
+
+// safeRelPath cleans a path from an archive or upload, refusing anything that would land outside the directory it's unpacked into.
+func safeRelPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("Invalid path: %s", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path: %s", name)
+	}
+	for _, part := range strings.Split(clean, "/") {
+		// Hidden directories like .precompressed are buildrone's own.
+		if part == precompressedDir || part == siteDir || strings.HasPrefix(part, uploadTmpPrefix) {
+			return "", fmt.Errorf("Invalid path: %s", name)
+		}
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+// extractLimits tracks how much of EXTRACT_MAX_SIZE and EXTRACT_MAX_FILES an archive has used.
+type extractLimits struct {
+	size  int64
+	files int
+	names []string // Paths of the files written, with forward slashes.
+}
+
+// writeFile copies r to dst/name, creating parent directories, and counts it against the limits.
+func (l *extractLimits) writeFile(dst, name string, r io.Reader) error {
+	rel, err := safeRelPath(name)
+	if err != nil {
+		return err
+	}
+	l.files++
+	if l.files > EXTRACT_MAX_FILES {
+		return fmt.Errorf("Archive has more than %d files", EXTRACT_MAX_FILES)
+	}
+	target := filepath.Join(dst, rel)
+	if err := os.MkdirAll(filepath.Dir(target), os.FileMode(DIRPERM)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// Sizes in archive headers can lie, so the limit is enforced on what's actually written.
+	n, err := io.Copy(f, io.LimitReader(r, EXTRACT_MAX_SIZE-l.size+1))
+	l.size += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if l.size > EXTRACT_MAX_SIZE {
+		return fmt.Errorf("Archive is larger than %s when unpacked", fileSize(EXTRACT_MAX_SIZE))
+	}
+	l.names = append(l.names, filepath.ToSlash(rel))
+	return nil
+}
+
+// isArchive reports whether a file can be unpacked by extractArchive.
+func isArchive(name string) bool {
+	return archiveExt(name) != ""
+}
+
+// extractArchive unpacks a zip or gzipped tarball into dst.
+func extractArchive(src, dst string, l *extractLimits) error {
+	if archiveExt(src) == ".zip" {
+		return extractZip(src, dst, l)
+	}
+	return extractTarGz(src, dst, l)
+}
+
+// extractZip unpacks the regular files in a zip archive into dst. Symlinks and other special files are skipped.
+func extractZip(src, dst string, l *extractLimits) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = l.writeFile(dst, zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTarGz unpacks the regular files in a gzipped tarball into dst. Links and other special files are skipped.
+func extractTarGz(src, dst string, l *extractLimits) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := l.writeFile(dst, hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// moveInto moves the files listed in l from src to the same paths under dst, replacing any already there.
+func moveInto(src, dst string, l *extractLimits) error {
+	for _, name := range l.names {
+		rel := filepath.FromSlash(name)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dst, rel)), os.FileMode(DIRPERM)); err != nil {
+			return err
+		}
+		removeVariants(filepath.Join(dst, rel))
+		if err := os.Rename(filepath.Join(src, rel), filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractUpload unpacks an uploaded archive into a build's folder, returning the names of the files written.
+// It's unpacked into a temporary directory first, so a rejected archive leaves the build as it was.
+// If keep is set, the archive itself is stored as rel too.
+func extractUpload(gc *gin.Context, file *multipart.FileHeader, dir, rel string, keep bool) ([]string, error) {
+	tmp, err := os.MkdirTemp(dir, uploadTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	archive := filepath.Join(tmp, "archive"+archiveExt(rel))
+	if err := gc.SaveUploadedFile(file, archive); err != nil {
+		return nil, err
+	}
+	limits := &extractLimits{}
+	files := filepath.Join(tmp, "files")
+	if err := extractArchive(archive, files, limits); err != nil {
+		return nil, err
+	}
+	if err := moveInto(files, dir, limits); err != nil {
+		return nil, err
+	}
+	if keep {
+		dst := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(DIRPERM)); err != nil {
+			return nil, err
+		}
+		removeVariants(dst)
+		if err := os.Rename(archive, dst); err != nil {
+			return nil, err
+		}
+		limits.names = append(limits.names, filepath.ToSlash(rel))
+	}
+	return limits.names, nil
+}
+
+func archiveExt(name string) string {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return ext
+		}
+	}
+	return ""
+}
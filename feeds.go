@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signatureSuffix marks a file holding the base64 EdDSA signature of the file it's named after, e.g. app.zip.sig. Used for Sparkle's edSignature.
+const signatureSuffix = ".sig"
+
+// feedEntry is a tag version with the artifact chosen for a feed.
+type feedEntry struct {
+	tagEntry
+	file      string
+	url       string
+	size      int64
+	sha256    string
+	signature string
+	mimeType  string
+}
+
+// feedFile picks the artifact for a feed item: the one matching platform, or the only file in the build if none was given.
+func (repo Repo) feedFile(build Build, platform string) (string, bool) {
+	if platform != "" {
+		return repo.platformFile(build, platform)
+	}
+	files, err := listBuildFiles(build)
+	if err != nil {
+		return "", false
+	}
+	candidates := []string{}
+	for _, f := range files {
+		if isDownloadable(f.Name) {
+			candidates = append(candidates, f.Name)
+		}
+	}
+	if len(candidates) != 1 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+// feedEntries returns up to limit ready versions of a tag with their artifacts, newest first.
+func (app *appContext) feedEntries(gc *gin.Context, repo Repo, tagName string, limit int) (entries []feedEntry) {
+	prerelease := gc.DefaultQuery("prerelease", "true") != "false"
+	platform := gc.Query("platform")
+	client := gc.Query("client")
+	for _, e := range repo.tagHistory(tagName) {
+		if len(entries) >= limit {
+			break
+		}
+		if !e.tag.Ready || e.build.Yanked || (!prerelease && e.semver.prerelease()) || !e.tag.servedTo(tagName, client) {
+			continue
+		}
+		fe := feedEntry{tagEntry: e}
+		if fname, ok := repo.feedFile(e.build, platform); ok {
+			fe.file = fname
+			fe.url = fileURL(gc, repo.Namespace, repo.Name, e.commit, fname)
+			if info, err := os.Stat(filepath.Join(STORAGE, e.build.Files, fname)); err == nil {
+				fe.size = info.Size()
+			}
+			if sum, err := app.buildChecksum(e.build, fname); err == nil {
+				fe.sha256 = sum
+			}
+			if sig, err := os.ReadFile(filepath.Join(STORAGE, e.build.Files, fname+signatureSuffix)); err == nil {
+				fe.signature = strings.TrimSpace(string(sig))
+			}
+			fe.mimeType = mime.TypeByExtension(filepath.Ext(fname))
+			if fe.mimeType == "" {
+				fe.mimeType = "application/octet-stream"
+			}
+		}
+		entries = append(entries, fe)
+	}
+	return
+}
+
+// notes returns the Markdown describing a release.
+func (e feedEntry) notes() string {
+	if e.tag.Notes != "" {
+		return e.tag.Notes
+	}
+	return releaseNotes(e.build, "")
+}
+
+// feedRepo is the shared setup for the feed endpoints.
+func (app *appContext) feedRepo(gc *gin.Context) (repo Repo, tagName string, limit int, ok bool) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	tagName = gc.Param("tag")
+	repo, ok = app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	limit, err := strconv.Atoi(gc.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		end(400, "Invalid limit", gc)
+		return repo, tagName, limit, false
+	}
+	return
+}
+
+type appcastRSS struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	Sparkle string         `xml:"xmlns:sparkle,attr"`
+	Channel appcastChannel `xml:"channel"`
+}
+
+type appcastChannel struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	Items       []appcastItem `xml:"item"`
+}
+
+type appcastItem struct {
+	Title          string            `xml:"title"`
+	PubDate        string            `xml:"pubDate"`
+	Version        string            `xml:"sparkle:version"`
+	ShortVersion   string            `xml:"sparkle:shortVersionString"`
+	Description    appcastCDATA      `xml:"description"`
+	CriticalUpdate *appcastCritical  `xml:"sparkle:criticalUpdate,omitempty"`
+	Enclosure      *appcastEnclosure `xml:"enclosure,omitempty"`
+}
+
+type appcastCDATA struct {
+	Text string `xml:",cdata"`
+}
+
+type appcastCritical struct {
+	Version string `xml:"sparkle:version,attr"`
+}
+
+type appcastEnclosure struct {
+	URL       string `xml:"url,attr"`
+	Length    int64  `xml:"length,attr"`
+	Type      string `xml:"type,attr"`
+	Signature string `xml:"sparkle:edSignature,attr,omitempty"`
+}
+
+// GetAppcast serves a Sparkle/WinSparkle appcast of a tag's ready versions.
+// Query: platform (picks the artifact, required if builds have more than one file), limit (default 10), prerelease=false, and client (see CheckUpdate).
+func (app *appContext) GetAppcast(gc *gin.Context) {
+	repo, tagName, limit, ok := app.feedRepo(gc)
+	if !ok {
+		return
+	}
+	rss := appcastRSS{
+		Version: "2.0",
+		Sparkle: "http://www.andymatuschak.org/xml-namespaces/sparkle",
+		Channel: appcastChannel{
+			Title:       fmt.Sprintf("%s/%s: %s", repo.Namespace, repo.Name, tagName),
+			Link:        fmt.Sprintf("%s/view/%s/%s", publicURL(gc), repo.Namespace, repo.Name),
+			Description: fmt.Sprintf("Updates for %s", repo.Name),
+		},
+	}
+	for _, e := range app.feedEntries(gc, repo, tagName, limit) {
+		item := appcastItem{
+			Title:        e.tag.Version,
+			PubDate:      e.date().Format(time.RFC1123Z),
+			Version:      e.tag.Version,
+			ShortVersion: e.tag.Version,
+			Description:  appcastCDATA{renderMarkdown(e.notes())},
+		}
+		if e.tag.MinVersion != "" {
+			item.CriticalUpdate = &appcastCritical{Version: e.tag.MinVersion}
+		}
+		if e.file != "" {
+			item.Enclosure = &appcastEnclosure{
+				URL:       e.url,
+				Length:    e.size,
+				Type:      e.mimeType,
+				Signature: e.signature,
+			}
+		}
+		rss.Channel.Items = append(rss.Channel.Items, item)
+	}
+	out, err := xml.MarshalIndent(rss, "", "  ")
+	if err != nil {
+		end(500, fmt.Sprintf("Couldn't generate appcast: %s", err), gc)
+		return
+	}
+	gc.Data(200, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), out...))
+}
+
+// JSONFeed follows JSON Feed 1.1 (https://jsonfeed.org/version/1.1), with buildrone's data in each item's "_buildrone" extension.
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedItem struct {
+	ID            string               `json:"id"` // Commit
+	Title         string               `json:"title"`
+	ContentText   string               `json:"content_text"` // Markdown release notes
+	ContentHTML   string               `json:"content_html"`
+	DatePublished string               `json:"date_published"` // RFC 3339
+	Attachments   []JSONFeedAttachment `json:"attachments,omitempty"`
+	Buildrone     JSONFeedExtension    `json:"_buildrone"`
+}
+
+type JSONFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Title    string `json:"title"`
+	Size     int64  `json:"size_in_bytes"`
+}
+
+type JSONFeedExtension struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	Branch     string `json:"branch,omitempty"`
+	Prerelease bool   `json:"prerelease"`
+	MinVersion string `json:"min_version,omitempty"`
+	File       string `json:"file,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	Signature  string `json:"signature,omitempty"` // Contents of the file's .sig, if uploaded.
+}
+
+// GetJSONFeed serves a tag's ready versions as a JSON Feed. Takes the same query as GetAppcast.
+func (app *appContext) GetJSONFeed(gc *gin.Context) {
+	repo, tagName, limit, ok := app.feedRepo(gc)
+	if !ok {
+		return
+	}
+	feed := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       fmt.Sprintf("%s/%s: %s", repo.Namespace, repo.Name, tagName),
+		HomePageURL: fmt.Sprintf("%s/view/%s/%s", publicURL(gc), repo.Namespace, repo.Name),
+		FeedURL:     publicURL(gc) + gc.Request.URL.RequestURI(),
+		Items:       []JSONFeedItem{},
+	}
+	for _, e := range app.feedEntries(gc, repo, tagName, limit) {
+		item := JSONFeedItem{
+			ID:            e.commit,
+			Title:         e.tag.Version,
+			ContentText:   e.notes(),
+			ContentHTML:   renderMarkdown(e.notes()),
+			DatePublished: e.date().Format(time.RFC3339),
+			Buildrone: JSONFeedExtension{
+				Version:    e.tag.Version,
+				Commit:     e.commit,
+				Branch:     e.build.Branch,
+				Prerelease: e.semver.prerelease(),
+				MinVersion: e.tag.MinVersion,
+				File:       e.file,
+				SHA256:     e.sha256,
+				Signature:  e.signature,
+			},
+		}
+		if e.file != "" {
+			item.Attachments = []JSONFeedAttachment{{
+				URL:      e.url,
+				MimeType: e.mimeType,
+				Title:    e.file,
+				Size:     e.size,
+			}}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	gc.Header("Content-Type", "application/feed+json; charset=utf-8")
+	gc.JSON(200, feed)
+}
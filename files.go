@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// buildFile is a downloadable file in a build. Name is its path relative to the build's folder, with forward slashes,
+// so files unpacked from an archive are named like "dist/app.js".
+type buildFile struct {
+	Name string
+	Size int64
+}
+
+// listBuildFiles returns the files in a build, sorted by name. Buildrone's own directories (the preview site and compressed copies) are left out.
+func listBuildFiles(build Build) ([]buildFile, error) {
+	files := []buildFile{}
+	if build.Files == "" {
+		return files, nil
+	}
+	root := filepath.Join(STORAGE, build.Files)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name := d.Name(); path != root && (name == siteDir || name == precompressedDir || strings.HasPrefix(name, uploadTmpPrefix)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		files = append(files, buildFile{Name: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, err
+}
+
+// buildHasFiles reports whether a build has any files to download.
+func buildHasFiles(build Build) bool {
+	files, err := listBuildFiles(build)
+	return err == nil && len(files) != 0
+}
+
+// buildFilePath returns where a file named as in listBuildFiles is stored, or false if the name could escape the build's folder.
+func buildFilePath(build Build, name string) (string, bool) {
+	rel, err := safeRelPath(name)
+	if err != nil || build.Files == "" {
+		return "", false
+	}
+	return filepath.Join(STORAGE, build.Files, rel), true
+}
+
+// isDownloadable reports whether a file should be offered as an artifact, rather than being metadata like checksums and signatures.
+func isDownloadable(name string) bool {
+	base := filepath.Base(filepath.FromSlash(name))
+	return base != checksumsFile && filepath.Ext(base) != signatureSuffix
+}
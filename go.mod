@@ -9,6 +9,7 @@ require (
 	github.com/evanw/esbuild v0.8.6 // indirect
 	github.com/gin-contrib/static v0.0.0-20200916080430-d45d9a37d28e
 	github.com/gin-gonic/gin v1.6.3
+	github.com/klauspost/compress v1.15.1
 	github.com/lithammer/shortuuid/v3 v3.0.4
 	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// hashCache holds SHA-256 sums of build files, keyed by path and invalidated if size or modification time change.
+type hashCache struct {
+	lock   sync.Mutex
+	hashes map[string]cachedHash
+}
+
+// sum returns the hex SHA-256 of a file, computing it if not cached.
+func (c *hashCache) sum(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	h, ok := c.hashes[path]
+	c.lock.Unlock()
+	if ok && h.size == info.Size() && h.modTime.Equal(info.ModTime()) {
+		return h.sum, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	h = cachedHash{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		sum:     hex.EncodeToString(hasher.Sum(nil)),
+	}
+	c.lock.Lock()
+	if c.hashes == nil {
+		c.hashes = map[string]cachedHash{}
+	}
+	c.hashes[path] = h
+	c.lock.Unlock()
+	return h.sum, nil
+}
+
+// checksumsFile is written by goreleaser and similar tools, as lines of "<sha256>  <file name>".
+const checksumsFile = "checksums.txt"
+
+// buildChecksum returns the SHA-256 of a file in a build, preferring the build's own checksums.txt if it lists it.
+func (app *appContext) buildChecksum(build Build, fname string) (string, error) {
+	if f, err := os.Open(filepath.Join(STORAGE, build.Files, checksumsFile)); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fname && len(fields[0]) == sha256.Size*2 {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+	}
+	return app.hashes.sum(filepath.Join(STORAGE, build.Files, fname))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// patternToRegexp turns a pattern like "{repo}/v{version}" into a regexp with named groups, matched against slash-separated paths relative to the import root.
+func patternToRegexp(pattern string) (*regexp.Regexp, error) {
+	placeholder := regexp.MustCompile(`\{([a-z]+)\}`)
+	expr := "^"
+	last := 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(pattern, -1) {
+		name := pattern[m[2]:m[3]]
+		switch name {
+		case "namespace", "repo", "commit", "version", "branch":
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		expr += regexp.QuoteMeta(pattern[last:m[0]]) + "(?P<" + name + ">[^/]+)"
+		last = m[1]
+	}
+	expr += regexp.QuoteMeta(pattern[last:]) + "$"
+	return regexp.Compile(expr)
+}
+
+func importDirCmd(args []string) {
+	fs := flag.NewFlagSet("import-dir", flag.ExitOnError)
+	fs.StringVar(&DATADIR, "data", DATADIR, "location of stored database and build files")
+	pattern := fs.String("pattern", "{repo}/{version}", "layout of build folders relative to the root. placeholders: {namespace}, {repo}, {commit}, {version}, {branch}")
+	namespace := fs.String("namespace", "", "namespace to use if the pattern has no {namespace}")
+	repoName := fs.String("repo", "", "repo name to use if the pattern has no {repo}")
+	branch := fs.String("branch", "", "branch to use if the pattern has no {branch}")
+	tagName := fs.String("tag", "", "if set, mark each imported build ready on this tag, with its version")
+	link := fs.Bool("link", false, "hardlink files into storage instead of copying them")
+	dryRun := fs.Bool("n", false, "print what would be imported without changing anything")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: buildrone import-dir [options] <directory>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	re, err := patternToRegexp(*pattern)
+	if err != nil {
+		log.Fatalf("Invalid pattern: %s", err)
+	}
+	if re.SubexpIndex("commit") == -1 && re.SubexpIndex("version") == -1 {
+		log.Fatalf("Pattern must contain {commit} or {version}")
+	}
+	if re.SubexpIndex("repo") == -1 && *repoName == "" {
+		log.Fatalf("Pattern has no {repo}, so -repo must be given")
+	}
+	if re.SubexpIndex("namespace") == -1 && *namespace == "" {
+		log.Fatalf("Pattern has no {namespace}, so -namespace must be given")
+	}
+	STORAGE = filepath.Join(DATADIR, "buildfiles")
+
+	app := &appContext{storage: map[string]Repo{}}
+	if err := app.read(); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to read storage: %s", err)
+	}
+	root := fs.Arg(0)
+	count := 0
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		m := re.FindStringSubmatch(filepath.ToSlash(rel))
+		if m == nil {
+			return nil
+		}
+		vals := map[string]string{
+			"namespace": *namespace,
+			"repo":      *repoName,
+			"branch":    *branch,
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				vals[name] = m[i]
+			}
+		}
+		if *dryRun {
+			log.Printf("%s: %s/%s commit \"%s\" version \"%s\"", rel, vals["namespace"], vals["repo"], vals["commit"], vals["version"])
+			count++
+			return filepath.SkipDir
+		}
+		if err := app.importDir(path, info.ModTime(), vals, *tagName, *link); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		count++
+		return filepath.SkipDir
+	})
+	if err != nil {
+		log.Fatalf("Failed to import: %s", err)
+	}
+	if *dryRun {
+		log.Printf("Would import %d builds", count)
+		return
+	}
+	if err := app.store(); err != nil {
+		log.Fatalf("Failed to store data: %s", err)
+	}
+	log.Printf("Imported %d builds into \"%s\"", count, DATADIR)
+}
+
+// importDir adds the files in src as a build, keyed by commit if known and version otherwise.
+func (app *appContext) importDir(src string, date time.Time, vals map[string]string, tagName string, link bool) error {
+	ns, name := vals["namespace"], vals["repo"]
+	key := vals["commit"]
+	if key == "" {
+		key = vals["version"]
+	}
+	id := ns + "/" + name
+	repo, ok := app.storage[id]
+	if !ok {
+		repo = Repo{
+			Namespace: ns,
+			Name:      name,
+		}
+	}
+	if repo.Builds == nil {
+		repo.Builds = map[string]Build{}
+	}
+	build, ok := repo.Builds[key]
+	if !ok {
+		build = Build{
+			Branch:   vals["branch"],
+			Name:     vals["version"],
+			Date:     date,
+			Imported: true,
+		}
+	}
+	commitDirectory := filepath.Join(ns, name, key)
+	if err := os.MkdirAll(filepath.Join(STORAGE, commitDirectory), os.FileMode(DIRPERM)); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		dst := filepath.Join(STORAGE, commitDirectory, f.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if link {
+			err = os.Link(filepath.Join(src, f.Name()), dst)
+		} else {
+			err = copyFile(filepath.Join(src, f.Name()), dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("%s/%s (%s): Imported %d files from \"%s\"", ns, name, key, len(files), src)
+	build.Files = commitDirectory
+	build.countSize()
+	build.DateChanged = date
+	if build.Branch != "" && !containsString(repo.Branches, build.Branch) {
+		repo.Branches = append(repo.Branches, build.Branch)
+	}
+	if tagName != "" {
+		if build.Tags == nil {
+			build.Tags = map[string]Tag{}
+		}
+		version := vals["version"]
+		if version == "" {
+			version = key
+		}
+		tag := Tag{
+			Ready:       true,
+			Version:     version,
+			ReleaseDate: Time{date},
+		}
+		build.Tags[tagName] = tag
+		if repo.LatestTags == nil {
+			repo.LatestTags = map[string]Tag{}
+		}
+		if latest, ok := repo.LatestTags[tagName]; !ok || !latest.ReleaseDate.After(date) {
+			repo.LatestTags[tagName] = tag
+		}
+	}
+	repo.Builds[key] = build
+	if latest, ok := repo.Builds[repo.LatestBuild]; !ok || !latest.Date.After(date) {
+		repo.LatestBuild = key
+	}
+	if latest, ok := repo.Builds[repo.LatestNonEmptyBuild]; (!ok || !latest.Date.After(date)) && len(files) != 0 {
+		repo.LatestNonEmptyBuild = key
+	}
+	app.storage[id] = repo
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+const linksFile = "links.gob"
+
+// linkRoute reports whether a request is for a file or a build's archive, the only routes signed links are accepted on.
+// Gin 1.6's FullPath can't tell them apart from the build's info, as /build/:build shares a node with /build/:build/:file.
+func linkRoute(gc *gin.Context) bool {
+	if gc.Param("file") != "" {
+		return true
+	}
+	parts := strings.Split(strings.TrimPrefix(gc.Request.URL.Path, "/"), "/")
+	return len(parts) == 5 && parts[0] == "repo" && parts[3] == "archive"
+}
+
+// SignedLink is a download link minted by an admin for one file in a build, or an archive of the whole build.
+// It works without any other auth, even for private repos, until it expires or has been used MaxDownloads times.
+type SignedLink struct {
+	Commit       string
+	File         string // Blank for the whole build.
+	Created      time.Time
+	Expires      time.Time
+	MaxDownloads int // 0 for no limit. Uses are counted in linkCounts.
+}
+
+type NewLinkReqDTO struct {
+	File         string // File in the build to link to. Leave blank to link to a zip of the whole build.
+	Hours        int    // How long the link lasts. Defaults to 24.
+	MaxDownloads int    // How many times it can be used. 0 for no limit.
+}
+
+type LinkDTO struct {
+	ID        string
+	URL       string
+	Downloads int
+	SignedLink
+}
+
+// linkCounts holds how many times each signed link has been used. It's saved to links.gob by linkSaver, so downloads don't rewrite storage.gob.
+type linkCounts struct {
+	lock      sync.Mutex
+	Downloads map[string]int // map[link ID]
+	dirty     bool
+	// When each client last started a download through each link, so it can resume it without being counted again.
+	started map[string]time.Time // map[link ID + "\x00" + IP]
+}
+
+// linkResumeWindow is how long after starting a download through a link a client can resume it.
+const linkResumeWindow = 24 * time.Hour
+
+func (c *linkCounts) load() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return readGob(linksFile, c)
+}
+
+func (c *linkCounts) save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := writeGob(linksFile, c); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *linkCounts) get(id string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Downloads[id]
+}
+
+// use counts a download through a link by a client, unless it's used up. If resuming, it's only let through uncounted
+// when the client started a download through the link recently; otherwise it counts as a new one.
+func (c *linkCounts) use(id string, max int, ip string, resuming bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := id + "\x00" + ip
+	if resuming {
+		if started, ok := c.started[key]; ok && time.Since(started) < linkResumeWindow {
+			return true
+		}
+	}
+	if max != 0 && c.Downloads[id] >= max {
+		return false
+	}
+	if c.Downloads == nil {
+		c.Downloads = map[string]int{}
+	}
+	if c.started == nil {
+		c.started = map[string]time.Time{}
+	}
+	c.Downloads[id]++
+	c.started[key] = time.Now()
+	c.dirty = true
+	return true
+}
+
+// pruneStarted forgets downloads too old to resume.
+func (c *linkCounts) pruneStarted() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, started := range c.started {
+		if time.Since(started) >= linkResumeWindow {
+			delete(c.started, key)
+		}
+	}
+}
+
+func (c *linkCounts) forget(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.Downloads[id]; ok {
+		delete(c.Downloads, id)
+		c.dirty = true
+	}
+}
+
+// linkSaver writes link counts to disk every minute.
+func (app *appContext) linkSaver() {
+	for {
+		time.Sleep(time.Minute)
+		app.links.pruneStarted()
+		if err := app.links.save(); err != nil {
+			log.Printf("Couldn't store link counts: %s", err)
+		}
+	}
+}
+
+// linkSignature is the HMAC of everything a link grants, so none of it can be changed without the repo's link secret.
+func linkSignature(secret, namespace, name, id, commit, file string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{namespace, name, id, commit, file, strconv.FormatInt(expires, 10)}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func archiveURL(gc *gin.Context, namespace, name, commit string) string {
+	return fmt.Sprintf("%s/repo/%s/%s/archive/%s", publicURL(gc), url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(commit))
+}
+
+func linkURL(gc *gin.Context, repo Repo, id string, link SignedLink) string {
+	u := archiveURL(gc, repo.Namespace, repo.Name, link.Commit)
+	if link.File != "" {
+		u = fileURL(gc, repo.Namespace, repo.Name, link.Commit, link.File)
+	}
+	expires := link.Expires.Unix()
+	sig := linkSignature(repo.LinkSecret, repo.Namespace, repo.Name, id, link.Commit, link.File, expires)
+	return fmt.Sprintf("%s?link=%s&expires=%d&sig=%s", u, url.QueryEscape(id), expires, sig)
+}
+
+func (app *appContext) linkActive(id string, link SignedLink) bool {
+	return time.Now().Before(link.Expires) && (link.MaxDownloads == 0 || app.links.get(id) < link.MaxDownloads)
+}
+
+// pruneLinks drops expired and used up links.
+func (app *appContext) pruneLinks(repo *Repo) {
+	for id, link := range repo.Links {
+		if !app.linkActive(id, link) {
+			delete(repo.Links, id)
+			app.links.forget(id)
+		}
+	}
+}
+
+// checkLink reports whether a request carries a valid, unexpired signed link for the build and file it's asking for.
+// It doesn't check the download count, which is left to useLink once the file's known to exist.
+func (app *appContext) checkLink(gc *gin.Context, repo Repo) (string, bool) {
+	id, sig := gc.Query("link"), gc.Query("sig")
+	if id == "" || sig == "" || repo.LinkSecret == "" || !linkRoute(gc) {
+		return "", false
+	}
+	link, ok := repo.Links[id]
+	if !ok || link.Commit != gc.Param("build") || link.File != gc.Param("file") {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(gc.Query("expires"), 10, 64)
+	if err != nil || expires != link.Expires.Unix() || time.Now().After(link.Expires) {
+		return "", false
+	}
+	want := linkSignature(repo.LinkSecret, repo.Namespace, repo.Name, id, link.Commit, link.File, expires)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", false
+	}
+	return id, true
+}
+
+// useLink counts a download through a signed link, if the request used one. If the link's invalid or used up, an error is sent and false returned.
+// Range requests continuing a download the same client started through the link aren't counted again, even once that used it up.
+func (app *appContext) useLink(gc *gin.Context, namespace, name string) bool {
+	if gc.Query("sig") == "" {
+		return true
+	}
+	repo := app.storage[namespace+"/"+name]
+	id, ok := app.checkLink(gc, repo)
+	if !ok {
+		end(403, "Invalid or expired link", gc)
+		return false
+	}
+	link := repo.Links[id]
+	// Each link is meant for one person, so no shared cache should serve it to others.
+	gc.Set("private", true)
+	r := gc.GetHeader("Range")
+	resuming := r != "" && !strings.HasPrefix(r, "bytes=0-")
+	if !app.links.use(id, link.MaxDownloads, gc.ClientIP(), resuming) {
+		end(410, "Link has been used up", gc)
+		return false
+	}
+	return true
+}
+
+// NewLink mints a signed link to a file in a build, or to the whole build if no file is given.
+func (app *appContext) NewLink(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("build")
+	var req NewLinkReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, "Build not found", gc)
+		return
+	}
+	if req.File != "" {
+		path, ok := buildFilePath(build, req.File)
+		if !ok {
+			end(400, fmt.Sprintf("Invalid file name: %s", req.File), gc)
+			return
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			end(400, fmt.Sprintf("File not found: %s", req.File), gc)
+			return
+		}
+	} else if !buildHasFiles(build) {
+		end(400, "Build has no files", gc)
+		return
+	}
+	if req.Hours <= 0 {
+		req.Hours = 24
+	}
+	if req.MaxDownloads < 0 {
+		end(400, "Invalid download limit", gc)
+		return
+	}
+	if repo.LinkSecret == "" {
+		repo.LinkSecret = shortuuid.New()
+	}
+	if repo.Links == nil {
+		repo.Links = map[string]SignedLink{}
+	}
+	app.pruneLinks(&repo)
+	id := shortuuid.New()
+	link := SignedLink{
+		Commit:       commit,
+		File:         req.File,
+		Created:      time.Now(),
+		Expires:      time.Now().Add(time.Duration(req.Hours) * time.Hour),
+		MaxDownloads: req.MaxDownloads,
+	}
+	repo.Links[id] = link
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s (%s): Created signed link to \"%s\" expiring %s", namespace, name, commit, req.File, link.Expires.Format(time.RFC3339))
+	gc.JSON(200, LinkDTO{ID: id, URL: linkURL(gc, repo, id, link), Downloads: app.links.get(id), SignedLink: link})
+}
+
+// GetLinks lists a repo's active signed links, newest first.
+func (app *appContext) GetLinks(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	resp := []LinkDTO{}
+	for id, link := range repo.Links {
+		if !app.linkActive(id, link) {
+			continue
+		}
+		resp = append(resp, LinkDTO{ID: id, URL: linkURL(gc, repo, id, link), Downloads: app.links.get(id), SignedLink: link})
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Created.After(resp[j].Created) })
+	gc.JSON(200, resp)
+}
+
+// DeleteLink revokes a signed link.
+func (app *appContext) DeleteLink(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	id := gc.Param("id")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if _, ok := repo.Links[id]; !ok {
+		end(400, fmt.Sprintf("Link not found: %s", id), gc)
+		return
+	}
+	delete(repo.Links, id)
+	app.links.forget(id)
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s: Revoked signed link %s", namespace, name, id)
+	gc.AbortWithStatus(204)
+}
+
+// GetArchive sends a zip of every file in a build, streamed as it's made.
+func (app *appContext) GetArchive(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("build")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, "Build not found", gc)
+		return
+	}
+	files, err := listBuildFiles(build)
+	if err != nil || len(files) == 0 {
+		end(400, "Build has no files", gc)
+		return
+	}
+	if !allowYankedDownload(gc, build) {
+		return
+	}
+	if !app.useLink(gc, namespace, name) {
+		return
+	}
+	gc.Header("Content-Type", "application/zip")
+	gc.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.zip", name, commit)))
+	zw := zip.NewWriter(throttle(gc.Writer))
+	for _, file := range files {
+		path, _ := buildFilePath(build, file.Name)
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("%s/%s (%s): Couldn't add \"%s\" to archive: %s", namespace, name, commit, file.Name, err)
+			continue
+		}
+		hdr := &zip.FileHeader{Name: file.Name, Method: zip.Deflate}
+		if info, err := f.Stat(); err == nil {
+			hdr.Modified = info.ModTime()
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err == nil {
+			_, err = io.Copy(w, f)
+		}
+		f.Close()
+		if err != nil {
+			// The response has already started, so all that can be done is to stop.
+			log.Printf("%s/%s (%s): Couldn't send archive: %s", namespace, name, commit, err)
+			return
+		}
+	}
+	zw.Close()
+	app.recordDownload(gc, namespace, name, commit, "")
+}
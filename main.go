@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"log"
@@ -10,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/adrg/xdg"
@@ -38,6 +38,10 @@ var (
 	MAXAGE             = ""
 	MAXAGEDELTA        maxAgeDelta
 	LOGIPS             = false
+	SNAPSHOTS          = 5      // Number of previous storage.gob files kept in DATADIR/snapshots, at most one an hour.
+	MINFREE            uint64   // Uploads are refused if they would leave less than this many bytes free.
+	PUBLIC_URL         = ""     // Address used in generated download links. If blank, taken from each request.
+	YANKED_DOWNLOADS   = "warn" // "warn" serves files from yanked builds with a Warning header, "block" refuses with 410.
 )
 
 func namespaceToServer(ns string) string {
@@ -91,9 +95,12 @@ func parseMaxAge(maxage string) (f maxAgeDelta) {
 // Tags are used for non-buildrone builds to tell apps that the specific update is ready, along with providing basic info. App is meant to do the heavylifting in terms of actually acquiring the build.
 // Created on-the-fly by upload.py
 type Tag struct {
-	Ready       bool   `json:"ready"`             // Whether or not build on this tag has completed.
-	Version     string `json:"version,omitempty"` // Version/Commit
-	ReleaseDate Time   `json:"date"`
+	Ready       bool     `json:"ready"`             // Whether or not build on this tag has completed.
+	Version     string   `json:"version,omitempty"` // Version/Commit
+	ReleaseDate Time     `json:"date"`
+	MinVersion  string   `json:"min_version,omitempty"` // Versions below this are no longer supported, and must update.
+	Rollout     *Rollout `json:"rollout,omitempty"`     // If set, only served to some clients. See servedTo.
+	Notes       string   `json:"notes,omitempty"`       // Markdown release notes.
 }
 
 type Build struct {
@@ -103,9 +110,15 @@ type Build struct {
 	Date        time.Time
 	DateChanged time.Time
 	Files       string
+	Size        int64 // Total bytes of Files. Precompressed copies are added on the next reload.
+	SizeCounted bool  // Size has been counted, so it isn't recounted on reload even if it's 0.
 	Link        string
-	Message     string
+	Message     string // Full commit message.
+	Notes       string // Markdown release notes, uploaded separately.
 	Tags        map[string]Tag
+	Imported    bool // Added by "buildrone import-dir" rather than found on Drone, so kept when reloading builds.
+	Yanked      bool // Withdrawn by an admin, so never served as latest, on a tag or channel.
+	YankReason  string
 }
 
 type Repo struct {
@@ -114,16 +127,29 @@ type Repo struct {
 	Branches                                                []string
 	Secret                                                  string
 	LatestTags                                              map[string]Tag
+	Channels                                                map[string]string     // map[channel]commit, e.g. "stable", "beta".
+	DefaultBranch                                           string                // If set, the plain /latest endpoints only serve builds from this branch.
+	PlatformRules                                           []PlatformRule        // Tried before defaultPlatformRules when classifying files.
+	Precompress                                             bool                  // Store gzip and zstd copies of uploaded files to serve clients that accept them.
+	Private                                                 bool                  // Only admins and holders of a read token can see the repo.
+	ReadSecret                                              string                // Signs read tokens. Regenerating it revokes them.
+	Links                                                   map[string]SignedLink // map[id], signed download links minted by an admin.
+	LinkSecret                                              string
 }
 
 type appContext struct {
-	config   *ini.File
-	client   drone.Client
-	storage  map[string]Repo
-	fs       http.FileSystem
-	Username string
-	Password string
-	logTo    string
+	config      *ini.File
+	client      drone.Client
+	storage     map[string]Repo
+	Username    string
+	Password    string
+	logTo       string
+	storeLock   sync.Mutex
+	maintenance Maintenance
+	hashes      hashCache
+	stats       statsStore
+	links       linkCounts
+	recounts    sizeRecounts
 }
 
 type RepoDTO struct {
@@ -134,18 +160,25 @@ type RepoDTO struct {
 	LatestCommit   string
 	LatestPush     BuildDTO
 	Secret         bool
+	Private        bool
 	Branches       []string
+	Size           int64             // Bytes used by the repo's files.
+	Channels       map[string]string // map[channel]commit
 }
 
 type BuildDTO struct {
-	ID      int64     // `json:"id"`
-	Name    string    // `json:"name"`
-	Date    time.Time // `json:"date"`
-	Files   []FileDTO // `json:"files"`
-	Link    string    // `json:"link"`
-	Message string
-	Branch  string // `json:"branch"`
-	Tags    map[string]Tag
+	ID         int64     // `json:"id"`
+	Name       string    // `json:"name"`
+	Date       time.Time // `json:"date"`
+	Files      []FileDTO // `json:"files"`
+	Link       string    // `json:"link"`
+	Message    string
+	Branch     string // `json:"branch"`
+	Tags       map[string]Tag
+	Yanked     bool
+	YankReason string
+	Notes      string // Release notes as sanitised HTML.
+	Preview    string `json:",omitempty"` // Address of the build's static site preview, if it has one.
 }
 
 type FileDTO struct {
@@ -218,11 +251,12 @@ func (app *appContext) loadBuilds(bl map[string]Build, ns, name string) (builds
 	for _, dBuild := range dBuildList {
 		commit := dBuild.After
 		build := Build{
-			ID:     dBuild.ID,
-			Name:   strings.Split(dBuild.Message, "\n")[0],
-			Date:   time.Unix(dBuild.Updated, 0),
-			Link:   dBuild.Link,
-			Branch: dBuild.Target,
+			ID:      dBuild.ID,
+			Name:    strings.Split(dBuild.Message, "\n")[0],
+			Date:    time.Unix(dBuild.Updated, 0),
+			Link:    dBuild.Link,
+			Branch:  dBuild.Target,
+			Message: dBuild.Message,
 		}
 		if build.Branch == "" {
 			build.Branch = dBuild.Source
@@ -241,8 +275,13 @@ func (app *appContext) loadBuilds(bl map[string]Build, ns, name string) (builds
 		}
 		if b, ok := bl[commit]; ok {
 			build.Files = b.Files
+			build.Size = b.Size
+			build.SizeCounted = b.SizeCounted
 			build.DateChanged = b.DateChanged
 			build.Tags = b.Tags
+			build.Notes = b.Notes
+			build.Yanked = b.Yanked
+			build.YankReason = b.YankReason
 			t := time.Time{}
 			if build.DateChanged == t {
 				build.DateChanged = build.Date
@@ -251,43 +290,43 @@ func (app *appContext) loadBuilds(bl map[string]Build, ns, name string) (builds
 				log.Printf("Removing old files for commit %s", commit)
 				os.RemoveAll(filepath.Join(STORAGE, build.Files))
 				build.Files = ""
+				build.Size = 0
+			}
+			// Builds stored before sizes were tracked.
+			if build.Files != "" && !build.SizeCounted {
+				build.countSize()
 			}
 		}
 		if build.Date.After(latestTime) {
 			latestTime = build.Date
 			latestBuild = commit
 		}
-		if build.Date.After(latestNETime) && build.Files != "" {
-			if d, err := os.ReadDir(filepath.Join(STORAGE, build.Files)); err == nil && len(d) != 0 {
+		if build.Date.After(latestNETime) && build.Files != "" && !build.Yanked {
+			if buildHasFiles(build) {
 				latestNETime = build.Date
 				latestNonEmptyBuild = commit
 			}
 		}
 		builds[commit] = build
 	}
-	return
-}
-
-func (app *appContext) store() error {
-	path := filepath.Join(DATADIR, "storage.gob")
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	enc := gob.NewEncoder(file)
-	return enc.Encode(app.storage)
-}
-
-func (app *appContext) read() error {
-	path := filepath.Join(DATADIR, "storage.gob")
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+	for commit, b := range bl {
+		if _, ok := builds[commit]; ok || !b.Imported {
+			continue
+		}
+		if b.Branch != "" && !containsString(branches, b.Branch) {
+			branches = append(branches, b.Branch)
+		}
+		if b.Date.After(latestTime) {
+			latestTime = b.Date
+			latestBuild = commit
+		}
+		if b.Date.After(latestNETime) && b.Files != "" && !b.Yanked {
+			latestNETime = b.Date
+			latestNonEmptyBuild = commit
+		}
+		builds[commit] = b
 	}
-	defer file.Close()
-	dec := gob.NewDecoder(file)
-	return dec.Decode(&app.storage)
+	return
 }
 
 func setKey(config *ini.File, key, value, comment string) {
@@ -308,7 +347,10 @@ func (app *appContext) loadAllBuilds() {
 			app.storage[n] = repo
 		}
 	}
-	app.store()
+	app.recountSizes()
+	if err := app.store(); err != nil {
+		log.Printf("Couldn't store data: %s", err)
+	}
 }
 
 func main() {
@@ -325,6 +367,19 @@ func main() {
 		}
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportCmd(os.Args[2:])
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importCmd(os.Args[2:])
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-dir" {
+		importDirCmd(os.Args[2:])
+		os.Exit(0)
+	}
+
 	flag.StringVar(&CONFIG, "config", CONFIG, "location of config file (ini)")
 	flag.StringVar(&DATADIR, "data", DATADIR, "location of stored database and build files")
 	flag.StringVar(&SERVE, "host", SERVE, "address to host app on")
@@ -358,7 +413,20 @@ func main() {
 		setKey(tempConfig, "max_file_age", "1y", "Maximum age of files on a commit. example: 1y30d2h (y = years, d = days, h = hours, m = minutes).")
 		setKey(tempConfig, "username", "your username", "Web UI username.")
 		setKey(tempConfig, "password_hash", "", "Web UI password hash. Generate by running \"buildrone password\".")
-		setKey(tempConfig, "user_log", "", "URL to log ips to, IP will be appended. Recommended for use with github.com/hrfee/ipcount. Leave blank to disable.")
+		setKey(tempConfig, "user_log", "", "URL to also send the IP of each download and update check to, IP will be appended. Downloads are counted in buildrone either way, so this is only needed for an external counter like github.com/hrfee/ipcount. Leave blank to disable.")
+		setKey(tempConfig, "trusted_proxies", "", "Comma separated IPs or CIDR ranges of reverse proxies allowed to pass on the client's address in X-Forwarded-For or X-Real-Ip. example: 127.0.0.1, 10.0.0.0/8. Leave blank if not behind a proxy.")
+		setKey(tempConfig, "rate_limit_downloads", "", "Most file downloads per client IP, as <requests>/<s|m|h>. Bursts of up to the full number are allowed. example: 60/m. Leave blank to disable.")
+		setKey(tempConfig, "rate_limit_polling", "", "Most tag, update and feed checks per client IP, as <requests>/<s|m|h>. example: 120/h. Leave blank to disable.")
+		setKey(tempConfig, "rate_limit_auth", "10/m", "Most token requests per client IP, as <requests>/<s|m|h>. Leave blank to disable.")
+		setKey(tempConfig, "download_bandwidth", "", "Most bandwidth per download, in bytes a second. example: 10M. Leave blank to disable.")
+		setKey(tempConfig, "stats_days", strconv.Itoa(STATS_DAYS), "Days of download statistics to keep.")
+		setKey(tempConfig, "storage_snapshots", strconv.Itoa(SNAPSHOTS), "Number of previous copies of the database to keep for recovery, taken at most hourly. 0 to disable.")
+		setKey(tempConfig, "min_free_space", "1G", "Uploads are refused with 507 if they would leave less than this much disk space free. example: 500M, 2G. Leave blank to disable. Not supported on Windows, where it's ignored.")
+		setKey(tempConfig, "extract_max_size", "1G", "Most data unpacked from one archive uploaded with extract=true. example: 500M, 2G.")
+		setKey(tempConfig, "extract_max_files", strconv.Itoa(EXTRACT_MAX_FILES), "Most files unpacked from one archive uploaded with extract=true.")
+		setKey(tempConfig, "public_url", "", "Public address of buildrone (e.g. https://builds.example.com), used in generated download links. Leave blank to use the address of each request.")
+		setKey(tempConfig, "preview_url", "", "Separate address (e.g. https://preview.example.com) pointing to buildrone that static site previews are served from. If blank, they're served from the main address. Either way they're sandboxed.")
+		setKey(tempConfig, "yanked_downloads", YANKED_DOWNLOADS, "What to do with downloads from yanked builds. \"warn\" adds a warning header, \"block\" refuses them.")
 		setKey(tempConfig, "woodpecker_user_override", "", "When using Woodpecker CI, set to the username/namespace -all- repos will be under.")
 		err = tempConfig.SaveTo(CONFIG)
 		if err != nil {
@@ -382,11 +450,46 @@ func main() {
 
 	app.storage = map[string]Repo{}
 	TOKEN_PERIOD = app.config.Section("").Key("token_period").MustInt(TOKEN_PERIOD)
+	SNAPSHOTS = app.config.Section("").Key("storage_snapshots").MustInt(SNAPSHOTS)
+	MINFREE, err = parseSize(app.config.Section("").Key("min_free_space").String())
+	if err != nil {
+		log.Fatalf("Failed to parse min_free_space: %s", err)
+	}
+	if _, _, err := diskSpace(DATADIR); MINFREE != 0 && err != nil {
+		log.Printf("Ignoring min_free_space: %s", err)
+	}
+	if s := app.config.Section("").Key("extract_max_size").String(); s != "" {
+		size, err := parseSize(s)
+		if err != nil {
+			log.Fatalf("Failed to parse extract_max_size: %s", err)
+		}
+		EXTRACT_MAX_SIZE = int64(size)
+	}
+	EXTRACT_MAX_FILES = app.config.Section("").Key("extract_max_files").MustInt(EXTRACT_MAX_FILES)
+	STATS_DAYS = app.config.Section("").Key("stats_days").MustInt(STATS_DAYS)
+	TRUSTED_PROXIES, err = parseTrustedProxies(app.config.Section("").Key("trusted_proxies").String())
+	if err != nil {
+		log.Fatalf("Failed to parse trusted_proxies: %s", err)
+	}
+	DOWNLOAD_BANDWIDTH, err = parseSize(app.config.Section("").Key("download_bandwidth").String())
+	if err != nil {
+		log.Fatalf("Failed to parse download_bandwidth: %s", err)
+	}
+	limits := map[string]*rateLimit{}
+	for _, group := range []string{"downloads", "polling", "auth"} {
+		limits[group], err = parseRate(app.config.Section("").Key("rate_limit_" + group).String())
+		if err != nil {
+			log.Fatalf("Failed to parse rate_limit_%s: %s", group, err)
+		}
+	}
 	os.Setenv("BUILDRONE_SECRET", app.config.Section("").Key("secret_key").String())
 	os.Setenv("BUILDRONE_WEBSECRET", shortuuid.New())
 	TOKEN = app.config.Section("").Key("drone_apikey").String()
 	HOST = app.config.Section("").Key("drone_host").String()
 	OVERRIDE_NAMESPACE = app.config.Section("").Key("woodpecker_user_override").String()
+	PUBLIC_URL = strings.TrimSuffix(app.config.Section("").Key("public_url").String(), "/")
+	PREVIEW_URL = strings.TrimSuffix(app.config.Section("").Key("preview_url").String(), "/")
+	YANKED_DOWNLOADS = app.config.Section("").Key("yanked_downloads").In(YANKED_DOWNLOADS, []string{"warn", "block"})
 	config := new(oauth2.Config)
 	auth := config.Client(
 		oauth2.NoContext,
@@ -402,9 +505,18 @@ func main() {
 	}
 
 	app.client = drone.NewClient(HOST, auth)
-	app.read()
-	log.Printf("Loading httpFilesystem")
-	app.fs = http.Dir(STORAGE)
+	if err := app.read(); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to read storage: %s", err)
+	}
+	app.loadMaintenance()
+	if err := app.stats.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't read stats: %s", err)
+	}
+	go app.statsSaver()
+	if err := app.links.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't read link counts: %s", err)
+	}
+	go app.linkSaver()
 	app.loadRepos()
 	log.Printf("Loading repos & builds")
 	app.loadAllBuilds()
@@ -415,27 +527,51 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	router := gin.New()
+	// Allows branch names with an encoded slash, e.g. feature%2Fthing.
+	router.UseRawPath = true
+	router.ForwardedByClientIP = false
+	router.Use(realIP())
 	router.Use(gin.Recovery())
+	downloadsLimit := newRateLimiter("downloads", limits["downloads"]).middleware()
+	pollingLimit := newRateLimiter("polling", limits["polling"]).middleware()
+	authLimit := newRateLimiter("auth", limits["auth"]).middleware()
+	router.Use(previewHost())
 	executable, _ := os.Executable()
 	router.LoadHTMLGlob(filepath.Join(filepath.Dir(executable), "templates/*"))
 	router.Use(static.Serve("/", static.LocalFile(filepath.Join(filepath.Dir(executable), "static"), false)))
-	router.GET("/repo/:namespace/:name/token", app.getBuildToken)
-	router.GET("/repo/:namespace/:name/tag/:build/:tag", app.GetTag)
-	router.GET("/repo/:namespace/:name/build/:build/:file", app.getFile)
-	router.GET("/repo/:namespace/:name/latest/file/:search", app.findLatest)
-	router.GET("/repo/:namespace/:name/latest", app.LatestCommit)
-	router.GET("/repo/:namespace/:name/build/:build", app.getBuild)
-	router.GET("/repo/:namespace/:name/builds/:page", app.getBuilds)
-	router.GET("/repo/:namespace/:name", app.getRepo)
+	router.GET("/repo/:namespace/:name/token", authLimit, app.getBuildToken)
+	readAPI := router.Group("/", app.readAuth())
+	readAPI.GET("/repo/:namespace/:name/tag/:build/:tag", pollingLimit, app.GetTag)
+	readAPI.GET("/repo/:namespace/:name/versions/:tag", pollingLimit, app.GetTagVersions)
+	readAPI.GET("/repo/:namespace/:name/tags", pollingLimit, app.GetTags)
+	readAPI.GET("/repo/:namespace/:name/update", pollingLimit, app.CheckUpdate)
+	readAPI.GET("/repo/:namespace/:name/appcast/:tag", pollingLimit, app.GetAppcast)
+	readAPI.GET("/repo/:namespace/:name/notes/:build", app.GetNotes)
+	readAPI.GET("/repo/:namespace/:name/compare/:from/:to", app.Compare)
+	readAPI.GET("/repo/:namespace/:name/feed/:tag", pollingLimit, app.GetJSONFeed)
+	readAPI.GET("/repo/:namespace/:name/build/:build/:file", downloadsLimit, app.getFile)
+	readAPI.GET("/repo/:namespace/:name/archive/:build", downloadsLimit, app.GetArchive)
+	readAPI.GET("/repo/:namespace/:name/latest/file/:search", downloadsLimit, app.findLatest)
+	readAPI.GET("/repo/:namespace/:name/latest/download", downloadsLimit, app.DownloadLatest)
+	readAPI.GET("/repo/:namespace/:name/latest", pollingLimit, app.LatestCommit)
+	readAPI.GET("/repo/:namespace/:name/branch/:branch/latest/file/:search", downloadsLimit, app.findLatest)
+	readAPI.GET("/repo/:namespace/:name/branch/:branch/latest/download", downloadsLimit, app.DownloadLatest)
+	readAPI.GET("/repo/:namespace/:name/branch/:branch/latest", pollingLimit, app.LatestCommit)
+	readAPI.GET("/repo/:namespace/:name/channel/:channel/file/:search", downloadsLimit, app.findChannel)
+	readAPI.GET("/repo/:namespace/:name/channel/:channel", pollingLimit, app.ChannelCommit)
+	readAPI.GET("/repo/:namespace/:name/build/:build", app.getBuild)
+	readAPI.GET("/repo/:namespace/:name/builds/:page", app.getBuilds)
+	readAPI.GET("/repo/:namespace/:name", app.getRepo)
+	readAPI.GET("/preview/:namespace/:name/:commit/*path", app.GetPreview)
 	router.GET("/", func(gc *gin.Context) {
 		gc.HTML(200, "admin.html", gin.H{})
 	})
-	router.GET("/view/:namespace/:name", func(gc *gin.Context) {
+	readAPI.GET("/view/:namespace/:name", func(gc *gin.Context) {
 		ns := gc.Param("namespace")
 		name := gc.Param("name")
 		_, ok := app.storage[ns+"/"+name]
 		if !ok {
-			end(400, fmt.Sprintf("Repo not found: %s/%s", ns, name), gc)
+			end(400, fmt.Sprintf("Repository not found: %s/%s", ns, name), gc)
 			return
 		}
 		gc.HTML(200, "repo.html", gin.H{
@@ -444,19 +580,44 @@ func main() {
 			"repoLink":  app.storage[ns+"/"+name].Link,
 		})
 	})
-	router.GET("/token", app.getWebToken)
+	router.GET("/token", authLimit, app.getWebToken)
 	adminAPI := router.Group("/", app.webAuth())
 	adminAPI.GET("/repos", app.getRepos)
-	adminAPI.POST("/repo/:namespace/:name/key", app.NewKey)
+	adminAPI.GET("/storage", app.getStorage)
+	adminAPI.GET("/stats", app.getStats)
+	adminAPI.GET("/repo/:namespace/:name/stats", app.getRepoStats)
+	adminAPI.GET("/maintenance", app.getMaintenance)
+	adminAPI.POST("/maintenance", app.setMaintenance)
+	adminAPI.POST("/repo/:namespace/:name/key", app.writable(), app.NewKey)
+	adminAPI.POST("/repo/:namespace/:name/readkey", app.writable(), app.NewReadKey)
+	adminAPI.DELETE("/repo/:namespace/:name/tags/:tag", app.writable(), app.DeleteTag)
+	adminAPI.DELETE("/repo/:namespace/:name/tags/:tag/:commit", app.writable(), app.DeleteTag)
+	adminAPI.POST("/repo/:namespace/:name/tags/:tag/rollback", app.writable(), app.RollbackTag)
+	adminAPI.POST("/repo/:namespace/:name/tags/:tag/rollout", app.writable(), app.SetRollout)
+	adminAPI.POST("/repo/:namespace/:name/build/:build/yank", app.writable(), app.YankBuild)
+	adminAPI.POST("/repo/:namespace/:name/build/:build/link", app.writable(), app.NewLink)
+	adminAPI.GET("/repo/:namespace/:name/links", app.GetLinks)
+	adminAPI.DELETE("/repo/:namespace/:name/links/:id", app.writable(), app.DeleteLink)
+	adminAPI.DELETE("/repo/:namespace/:name/build/:build/yank", app.writable(), app.UnyankBuild)
+	adminAPI.GET("/repo/:namespace/:name/settings", app.getRepoSettings)
+	adminAPI.POST("/repo/:namespace/:name/settings", app.writable(), app.setRepoSettings)
+	adminAPI.POST("/repo/:namespace/:name/channel/:channel", app.writable(), app.SetChannel)
+	adminAPI.DELETE("/repo/:namespace/:name/channel/:channel", app.writable(), app.DeleteChannel)
 	handler := func(gc *gin.Context) {
 		query := gc.Param("query")
 		if query == "add" {
 			app.addFiles(gc)
 		} else if query == "tag" {
 			app.SetTag(gc)
+		} else if query == "promote" {
+			app.PromoteBuild(gc)
+		} else if query == "notes" {
+			app.SetNotes(gc)
+		} else if query == "site" {
+			app.SetSite(gc)
 		}
 	}
-	buildAPI := router.Group("/", app.buildAuth())
+	buildAPI := router.Group("/", app.buildAuth(), app.writable())
 	buildAPI.POST("/repo/:namespace/:name/commit/:commit/:query", handler)
 	buildAPI.POST("/repo/:namespace/:name/commit/:commit/:query/:tag", handler)
 	srv := &http.Server{
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maintenanceFile = "maintenance.json"
+
+// Maintenance puts the instance in read-only mode: downloads keep working, but uploads, tags and new keys are refused.
+type Maintenance struct {
+	Enabled bool
+	Message string // Shown in the error returned to refused requests.
+}
+
+// parseSize parses a size like "500M", "2G" or "1gb" (powers of 1000, as in fileSize) into bytes.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if s == "" {
+		return 0, nil
+	}
+	mult := uint64(1)
+	if i := strings.IndexByte("KMGTPE", s[len(s)-1]); i != -1 {
+		for ; i >= 0; i-- {
+			mult *= 1000
+		}
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size \"%s\"", s)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+func (app *appContext) loadMaintenance() {
+	data, err := os.ReadFile(filepath.Join(DATADIR, maintenanceFile))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &app.maintenance); err != nil {
+		log.Printf("Couldn't read maintenance state: %s", err)
+	}
+	if app.maintenance.Enabled {
+		log.Printf("Maintenance mode is enabled, uploads are disabled")
+	}
+}
+
+func (app *appContext) storeMaintenance() error {
+	data, err := json.Marshal(app.maintenance)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(DATADIR, maintenanceFile), data, 0600)
+}
+
+// writable refuses requests which would modify stored builds while in maintenance mode.
+func (app *appContext) writable() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if app.maintenance.Enabled {
+			msg := "Server is in maintenance mode, uploads are disabled"
+			if app.maintenance.Message != "" {
+				msg += ": " + app.maintenance.Message
+			}
+			abort(503, msg, gc)
+			return
+		}
+		gc.Next()
+	}
+}
+
+// enoughSpace reports whether writing size more bytes would keep free space above MINFREE.
+func enoughSpace(size int64) bool {
+	if MINFREE == 0 {
+		return true
+	}
+	free, _, err := diskSpace(DATADIR)
+	if err != nil {
+		log.Printf("Couldn't get free disk space: %s", err)
+		return true
+	}
+	if size < 0 {
+		size = 0
+	}
+	return free >= MINFREE+uint64(size)
+}
+
+func (app *appContext) getMaintenance(gc *gin.Context) {
+	gc.JSON(200, app.maintenance)
+}
+
+func (app *appContext) setMaintenance(gc *gin.Context) {
+	var req Maintenance
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	app.maintenance = req
+	if req.Enabled {
+		log.Printf("Maintenance mode enabled")
+	} else {
+		log.Printf("Maintenance mode disabled")
+	}
+	if err := app.storeMaintenance(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store maintenance state: %s", err), gc)
+		return
+	}
+	gc.JSON(200, app.maintenance)
+}
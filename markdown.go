@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// renderMarkdown converts the commonly used parts of Markdown (headings, paragraphs, lists, quotes, code, emphasis and links) to HTML.
+// All text is escaped before any markup is added, and links are limited to http(s) and mailto, so the output is safe to embed even from untrusted input. Raw HTML is shown as text.
+func renderMarkdown(src string) string {
+	var out strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var para []string
+	list := ""
+	flushPara := func() {
+		if len(para) != 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushPara()
+			closeList()
+			code := []string{}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case mdHeading.MatchString(trimmed):
+			flushPara()
+			closeList()
+			m := mdHeading.FindStringSubmatch(trimmed)
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+		case mdRule.MatchString(trimmed):
+			flushPara()
+			closeList()
+			out.WriteString("<hr>\n")
+		case mdBullet.MatchString(trimmed):
+			flushPara()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(mdBullet.ReplaceAllString(trimmed, "")) + "</li>\n")
+		case mdNumbered.MatchString(trimmed):
+			flushPara()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(mdNumbered.ReplaceAllString(trimmed, "")) + "</li>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			closeList()
+			quote := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			out.WriteString("<blockquote><p>" + renderInline(strings.Join(quote, "\n")) + "</p></blockquote>\n")
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+	closeList()
+	return out.String()
+}
+
+var (
+	mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdRule     = regexp.MustCompile(`^(\*\s*){3,}$|^(-\s*){3,}$|^(_\s*){3,}$`)
+	mdBullet   = regexp.MustCompile(`^[-*+]\s+`)
+	mdNumbered = regexp.MustCompile(`^\d+[.)]\s+`)
+	mdCode     = regexp.MustCompile("`([^`]+)`")
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\(((?:https?://|mailto:)[^)\s]+)\)`)
+	mdBold     = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdItalic   = regexp.MustCompile(`\*([^*\s][^*]*?)\*`)
+)
+
+// renderInline renders code spans, links and emphasis in a line of already split-up Markdown.
+func renderInline(s string) string {
+	// Code spans are rendered first and kept out of the other rules.
+	var out strings.Builder
+	last := 0
+	for _, m := range mdCode.FindAllStringSubmatchIndex(s, -1) {
+		out.WriteString(renderEmphasis(s[last:m[0]]))
+		out.WriteString("<code>" + html.EscapeString(s[m[2]:m[3]]) + "</code>")
+		last = m[1]
+	}
+	out.WriteString(renderEmphasis(s[last:]))
+	return strings.ReplaceAll(out.String(), "\n", "<br>\n")
+}
+
+func renderEmphasis(s string) string {
+	s = html.EscapeString(s)
+	s = mdLink.ReplaceAllString(s, `<a href="$2" rel="nofollow noopener">$1</a>`)
+	s = mdBold.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = mdItalic.ReplaceAllString(s, "<em>$1</em>")
+	return s
+}
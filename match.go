@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fileMatcher reports whether a file name matches a pattern, ignoring case.
+type fileMatcher func(name string) bool
+
+// newFileMatcher compiles pattern in the given mode: "substring" (the default), "glob" (see path.Match) or "regex".
+func newFileMatcher(mode, pattern string) (fileMatcher, error) {
+	switch mode {
+	case "", "substring":
+		pattern = strings.ToLower(pattern)
+		return func(name string) bool { return strings.Contains(strings.ToLower(name), pattern) }, nil
+	case "glob":
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid glob \"%s\": %s", pattern, err)
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(name))
+			return ok
+		}, nil
+	case "regex":
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex \"%s\": %s", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("Unknown match mode: %s", mode)
+}
+
+// priorityRank returns the index of the first entry of priority contained in name, or len(priority) if none are.
+func priorityRank(name string, priority []string) int {
+	name = strings.ToLower(name)
+	for i, p := range priority {
+		if p != "" && strings.Contains(name, strings.ToLower(p)) {
+			return i
+		}
+	}
+	return len(priority)
+}
+
+// matchFiles returns the files in a build matching search, the one to serve first.
+// Query: match (substring, glob or regex), exclude (a pattern in the same mode), and priority (comma-separated substrings, earlier ones preferred).
+// Ties are broken by the shortest name, then alphabetically.
+func matchFiles(gc *gin.Context, build Build, search string) ([]string, int, error) {
+	mode := gc.Query("match")
+	include, err := newFileMatcher(mode, search)
+	if err != nil {
+		return nil, 400, err
+	}
+	exclude := func(string) bool { return false }
+	if pattern := gc.Query("exclude"); pattern != "" {
+		if exclude, err = newFileMatcher(mode, pattern); err != nil {
+			return nil, 400, err
+		}
+	}
+	var priority []string
+	if p := gc.Query("priority"); p != "" {
+		priority = strings.Split(p, ",")
+	}
+	files, err := listBuildFiles(build)
+	if err != nil {
+		return nil, 500, fmt.Errorf("Couldn't read directory")
+	}
+	matches := []string{}
+	for _, f := range files {
+		if include(f.Name) && !exclude(f.Name) {
+			matches = append(matches, f.Name)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if pa, pb := priorityRank(a, priority), priorityRank(b, priority); pa != pb {
+			return pa < pb
+		}
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	return matches, 200, nil
+}
+
+type MatchDTO struct {
+	Name string
+	Size int64
+	URL  string
+}
+
+// serveMatch redirects to the best file in the build matching search (see matchFiles), or with ?list=true, lists every match in order.
+func (app *appContext) serveMatch(gc *gin.Context, namespace, name, commit string, build Build, search string) {
+	matches, status, err := matchFiles(gc, build, search)
+	if err != nil {
+		end(status, err.Error(), gc)
+		return
+	}
+	if gc.Query("list") == "true" {
+		resp := []MatchDTO{}
+		for _, m := range matches {
+			dto := MatchDTO{Name: m, URL: fileURL(gc, namespace, name, commit, m)}
+			if info, err := os.Stat(filepath.Join(STORAGE, build.Files, m)); err == nil {
+				dto.Size = info.Size()
+			}
+			resp = append(resp, dto)
+		}
+		gc.JSON(200, resp)
+		return
+	}
+	if len(matches) == 0 {
+		end(404, "No matching file found", gc)
+		return
+	}
+	redirectToFile(gc, namespace, name, commit, matches[0])
+}
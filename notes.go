@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MAXNOTES is the largest release notes upload accepted, in bytes.
+const MAXNOTES = 1 << 20
+
+// SetNotes is the build API's /commit/:commit/notes and /commit/:commit/notes/:tag.
+// The request body is stored as Markdown release notes on the build, or on its tag if given.
+func (app *appContext) SetNotes(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("commit")
+	tagName := gc.Param("tag")
+	body, err := io.ReadAll(io.LimitReader(gc.Request.Body, MAXNOTES+1))
+	if err != nil {
+		end(400, fmt.Sprintf("Couldn't read notes: %s", err), gc)
+		return
+	}
+	if len(body) > MAXNOTES {
+		end(413, "Notes too large", gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if _, ok := repo.Builds[commit]; !ok {
+		repo.Builds, repo.Branches, repo.LatestBuild, repo.LatestNonEmptyBuild, err = app.loadBuilds(repo.Builds, namespaceToServer(namespace), name)
+		if err != nil {
+			end(500, "Couldn't load builds", gc)
+			return
+		}
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, fmt.Sprintf("Commit not found: %s", commit), gc)
+		return
+	}
+	if tagName != "" {
+		tag, ok := build.Tags[tagName]
+		if !ok {
+			end(400, fmt.Sprintf("Tag \"%s\" not found on commit %s", tagName, commit), gc)
+			return
+		}
+		tag.Notes = string(body)
+		build.Tags[tagName] = tag
+		repo.Builds[commit] = build
+		repo.recomputeLatestTag(tagName)
+	} else {
+		build.Notes = string(body)
+		repo.Builds[commit] = build
+	}
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s (%s): Stored release notes", namespace, name, commit)
+	end(200, "Notes stored", gc)
+}
+
+// releaseNotes returns the Markdown describing a build, or a tag on it if given: the tag's notes, then the build's, then its commit message.
+func releaseNotes(build Build, tagName string) string {
+	if tag, ok := build.Tags[tagName]; ok && tag.Notes != "" {
+		return tag.Notes
+	}
+	if build.Notes != "" {
+		return build.Notes
+	}
+	if build.Message != "" {
+		return build.Message
+	}
+	return build.Name
+}
+
+// GetNotes serves a build's release notes as Markdown, or as sanitised HTML with ?format=html. ?tag= gets a tag's notes instead.
+func (app *appContext) GetNotes(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("build")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, "Build not found", gc)
+		return
+	}
+	notes := releaseNotes(build, gc.Query("tag"))
+	if gc.Query("format") == "html" {
+		gc.Header("Content-Security-Policy", "default-src 'none'")
+		gc.Data(200, "text/html; charset=utf-8", []byte(renderMarkdown(notes)))
+		return
+	}
+	gc.Data(200, "text/markdown; charset=utf-8", []byte(notes))
+}
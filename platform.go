@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlatformRule classifies files whose names match Pattern (a case-insensitive regular expression).
+// Blank fields are left to later rules. A repo's own rules are tried before defaultPlatformRules.
+type PlatformRule struct {
+	Pattern string
+	OS      string `json:",omitempty"`
+	Arch    string `json:",omitempty"`
+	Type    string `json:",omitempty"`
+}
+
+// Separators around a word in a file name. Underscores aren't included, so "x86" doesn't match "x86_64".
+const (
+	wordStart = `(^|[^a-z0-9])`
+	wordEnd   = `([^a-z0-9_]|$)`
+)
+
+var defaultPlatformRules = []PlatformRule{
+	{Pattern: `\.(exe|msi|msix|appx)$`, OS: "windows"},
+	{Pattern: `\.(dmg|pkg)$`, OS: "macos"},
+	{Pattern: `\.(deb|rpm|appimage|flatpak|snap)$`, OS: "linux"},
+	{Pattern: `\.apk$`, OS: "android"},
+	{Pattern: wordStart + `(windows|win|win32|win64)` + wordEnd, OS: "windows"},
+	{Pattern: wordStart + `(macos|mac|osx|darwin)` + wordEnd, OS: "macos"},
+	{Pattern: wordStart + `linux` + wordEnd, OS: "linux"},
+	{Pattern: wordStart + `freebsd` + wordEnd, OS: "freebsd"},
+	{Pattern: wordStart + `android` + wordEnd, OS: "android"},
+	{Pattern: wordStart + `(amd64|x86_64|x64|win64)` + wordEnd, Arch: "amd64"},
+	{Pattern: wordStart + `(arm64|aarch64)` + wordEnd, Arch: "arm64"},
+	{Pattern: wordStart + `(armv7l?|armhf|arm)` + wordEnd, Arch: "arm"},
+	{Pattern: wordStart + `(386|i386|i686|x86|win32)` + wordEnd, Arch: "386"},
+	{Pattern: wordStart + `universal` + wordEnd, Arch: "universal"},
+	{Pattern: `\.tar\.gz$|\.tgz$`, Type: "tar.gz"},
+	{Pattern: `\.tar\.xz$`, Type: "tar.xz"},
+	{Pattern: `\.tar\.zst$`, Type: "tar.zst"},
+	{Pattern: `\.(zip|exe|msi|msix|appx|dmg|pkg|deb|rpm|appimage|flatpak|snap|apk)$`, Type: "$1"},
+}
+
+// platformAliases maps other names for an OS or arch to those used by the rules.
+var platformAliases = map[string]string{
+	"win":     "windows",
+	"win32":   "windows",
+	"mac":     "macos",
+	"osx":     "macos",
+	"darwin":  "macos",
+	"x86_64":  "amd64",
+	"x64":     "amd64",
+	"aarch64": "arm64",
+	"armv7":   "arm",
+	"armhf":   "arm",
+	"i386":    "386",
+	"i686":    "386",
+	"x86":     "386",
+	"tgz":     "tar.gz",
+}
+
+func normalisePlatform(s string) string {
+	s = strings.ToLower(strings.TrimPrefix(s, "."))
+	if alias, ok := platformAliases[s]; ok {
+		return alias
+	}
+	return s
+}
+
+// compilePlatformRules checks and compiles a repo's rules followed by the defaults.
+func compilePlatformRules(rules []PlatformRule) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(rules)+len(defaultPlatformRules))
+	for _, r := range append(append([]PlatformRule{}, rules...), defaultPlatformRules...) {
+		re, err := regexp.Compile("(?i)" + r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern \"%s\": %s", r.Pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// ArtifactDTO is a file in a build with its platform, as classified by PlatformRules.
+type ArtifactDTO struct {
+	Name string
+	OS   string
+	Arch string
+	Type string
+	URL  string
+}
+
+// classifyFiles returns the files in a build (besides checksums and signatures) with their platforms, sorted by name.
+func (repo Repo) classifyFiles(build Build) ([]ArtifactDTO, error) {
+	rules := append(append([]PlatformRule{}, repo.PlatformRules...), defaultPlatformRules...)
+	compiled, err := compilePlatformRules(repo.PlatformRules)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listBuildFiles(build)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read directory")
+	}
+	artifacts := []ArtifactDTO{}
+	for _, f := range files {
+		if !isDownloadable(f.Name) {
+			continue
+		}
+		a := ArtifactDTO{Name: f.Name}
+		for i, re := range compiled {
+			m := re.FindStringSubmatchIndex(a.Name)
+			if m == nil {
+				continue
+			}
+			expand := func(field *string, template string) {
+				if *field == "" && template != "" {
+					*field = strings.ToLower(string(re.ExpandString(nil, template, a.Name, m)))
+				}
+			}
+			expand(&a.OS, rules[i].OS)
+			expand(&a.Arch, rules[i].Arch)
+			expand(&a.Type, rules[i].Type)
+		}
+		if a.Type == "" {
+			a.Type = strings.ToLower(strings.TrimPrefix(filepath.Ext(a.Name), "."))
+		}
+		artifacts = append(artifacts, a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// userAgentPlatform guesses a client's OS and arch from its User-Agent. Either may be blank.
+// Browsers on Apple Silicon still claim to be Intel, so no arch is guessed for macOS.
+func userAgentPlatform(ua string) (goos, arch string) {
+	ua = strings.ToLower(ua)
+	switch {
+	case strings.Contains(ua, "android"):
+		goos = "android"
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		goos = "ios"
+	case strings.Contains(ua, "windows"):
+		goos = "windows"
+	case strings.Contains(ua, "mac os x"), strings.Contains(ua, "macintosh"), strings.Contains(ua, "darwin"):
+		return "macos", ""
+	case strings.Contains(ua, "freebsd"):
+		goos = "freebsd"
+	case strings.Contains(ua, "linux"):
+		goos = "linux"
+	}
+	switch {
+	case strings.Contains(ua, "aarch64"), strings.Contains(ua, "arm64"):
+		arch = "arm64"
+	case strings.Contains(ua, "x86_64"), strings.Contains(ua, "amd64"), strings.Contains(ua, "win64"), strings.Contains(ua, "wow64"), strings.Contains(ua, "x64"):
+		arch = "amd64"
+	case strings.Contains(ua, "armv7"), strings.Contains(ua, "armv8l"):
+		arch = "arm"
+	case strings.Contains(ua, "i686"), strings.Contains(ua, "i386"):
+		arch = "386"
+	}
+	return
+}
+
+// platformFile picks the file in a build for a platform given as words like "windows-x64" or "linux-arm64-deb", each of which must be
+// the OS, arch or type the repo's PlatformRules give the file. Universal builds fit any arch. If more than one fits, the shortest name wins.
+func (repo Repo) platformFile(build Build, platform string) (string, bool) {
+	words := strings.FieldsFunc(platform, func(r rune) bool { return r == '-' || r == ',' || r == '/' || r == ' ' })
+	if len(words) == 0 {
+		return "", false
+	}
+	artifacts, err := repo.classifyFiles(build)
+	if err != nil {
+		return "", false
+	}
+	archs := map[string]bool{}
+	for _, r := range defaultPlatformRules {
+		archs[r.Arch] = r.Arch != ""
+	}
+	for _, a := range artifacts {
+		archs[a.Arch] = a.Arch != ""
+	}
+	for _, w := range words {
+		w = normalisePlatform(w)
+		artifacts = filterArtifacts(artifacts, func(a ArtifactDTO) bool {
+			return a.OS == w || a.Arch == w || a.Type == w || (a.Arch == "universal" && archs[w])
+		})
+	}
+	if len(artifacts) == 0 {
+		return "", false
+	}
+	sort.SliceStable(artifacts, func(i, j int) bool { return len(artifacts[i].Name) < len(artifacts[j].Name) })
+	return artifacts[0].Name, true
+}
+
+func filterArtifacts(artifacts []ArtifactDTO, keep func(a ArtifactDTO) bool) []ArtifactDTO {
+	out := []ArtifactDTO{}
+	for _, a := range artifacts {
+		if keep(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// DownloadLatest redirects to the latest build's file for a platform, given as ?os=, ?arch= and ?type=.
+// Without os or arch, they're guessed from the User-Agent. If more than one file fits, responds 300 with the choices.
+func (app *appContext) DownloadLatest(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	commit, build, ok := repo.latestBuild(gc.Param("branch"))
+	if !ok {
+		end(404, "Couldn't find latest build", gc)
+		return
+	}
+	artifacts, err := repo.classifyFiles(build)
+	if err != nil {
+		end(500, err.Error(), gc)
+		return
+	}
+	goos, arch, fileType := normalisePlatform(gc.Query("os")), normalisePlatform(gc.Query("arch")), normalisePlatform(gc.Query("type"))
+	if goos != "" || arch != "" {
+		artifacts = filterArtifacts(artifacts, func(a ArtifactDTO) bool {
+			return (goos == "" || a.OS == goos) && (arch == "" || a.Arch == arch || a.Arch == "universal")
+		})
+	} else if goos, arch = userAgentPlatform(gc.GetHeader("User-Agent")); goos != "" {
+		// The User-Agent is only a guess, so if nothing was built for it, every file is offered instead.
+		if byOS := filterArtifacts(artifacts, func(a ArtifactDTO) bool { return a.OS == goos }); len(byOS) != 0 {
+			artifacts = byOS
+			if byArch := filterArtifacts(artifacts, func(a ArtifactDTO) bool { return a.Arch == arch || a.Arch == "universal" }); arch != "" && len(byArch) != 0 {
+				artifacts = byArch
+			}
+		}
+	}
+	if fileType != "" {
+		artifacts = filterArtifacts(artifacts, func(a ArtifactDTO) bool { return a.Type == fileType })
+	}
+	if len(artifacts) == 0 {
+		end(404, "No matching file found", gc)
+		return
+	}
+	if len(artifacts) > 1 {
+		for i := range artifacts {
+			artifacts[i].URL = fileURL(gc, namespace, name, commit, artifacts[i].Name)
+		}
+		gc.JSON(300, artifacts)
+		return
+	}
+	redirectToFile(gc, namespace, name, commit, artifacts[0].Name)
+}
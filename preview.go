@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// siteDir is the directory inside a build's folder holding its static site preview.
+const siteDir = ".site"
+
+// PREVIEW_URL is the separate origin previews are served from, e.g. https://preview.example.com. If blank, they're served from
+// buildrone's own. Either way they're sandboxed by a Content-Security-Policy, so their scripts can't use the admin's session,
+// or read other previews sharing the origin.
+var PREVIEW_URL = ""
+
+// previewTokenSegment starts the part of a private preview's path holding its read token, as in /preview/<ns>/<repo>/<commit>/~token/<token>/.
+// Being in the path, relative links in the site keep it. Sandboxed pages don't send cookies, and a cookie would also let any other preview
+// on the origin read the repo.
+const previewTokenSegment = "~token"
+
+// previewPathToken splits a read token off the start of a preview's path, returning it and the rest of the path.
+func previewPathToken(p string) (token, rest string) {
+	prefix := "/" + previewTokenSegment + "/"
+	if !strings.HasPrefix(p, prefix) {
+		return "", p
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, prefix), "/", 2)
+	rest = "/"
+	if len(parts) == 2 {
+		rest += parts[1]
+	}
+	return parts[0], rest
+}
+
+// previewURL is the address of a build's preview.
+func previewURL(gc *gin.Context, namespace, name, commit string) string {
+	base := PREVIEW_URL
+	if base == "" {
+		base = publicURL(gc)
+	}
+	return fmt.Sprintf("%s/preview/%s/%s/%s/", base, url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(commit))
+}
+
+func hasPreview(build Build) bool {
+	if build.Files == "" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(STORAGE, build.Files, siteDir))
+	return err == nil && info.IsDir()
+}
+
+// previewHost is middleware keeping the preview origin (if PREVIEW_URL is set) to previews, so nothing else of buildrone's is reachable from it.
+func previewHost() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if PREVIEW_URL == "" {
+			return
+		}
+		u, err := url.Parse(PREVIEW_URL)
+		if err != nil || !strings.EqualFold(gc.Request.Host, u.Host) {
+			return
+		}
+		if !strings.HasPrefix(gc.Request.URL.Path, "/preview/") {
+			end(404, "Not found", gc)
+			gc.Abort()
+		}
+	}
+}
+
+// SetSite is the build API's /commit/:commit/site. It replaces the build's preview with the uploaded files, named by their path in
+// the site (e.g. "css/main.css"), or the contents of a single uploaded .zip.
+func (app *appContext) SetSite(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("commit")
+	if !enoughSpace(gc.Request.ContentLength) {
+		end(507, "Not enough free disk space", gc)
+		log.Printf("%s/%s: Refused upload, not enough free disk space", namespace, name)
+		return
+	}
+	form, err := gc.MultipartForm()
+	if err != nil {
+		end(400, fmt.Sprintf("Form error: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if _, ok := repo.Builds[commit]; !ok {
+		repo.Builds, repo.Branches, repo.LatestBuild, repo.LatestNonEmptyBuild, err = app.loadBuilds(repo.Builds, namespaceToServer(namespace), name)
+		if err != nil {
+			end(500, "Couldn't load builds", gc)
+			return
+		}
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, fmt.Sprintf("Commit not found: %s", commit), gc)
+		return
+	}
+	if build.Files == "" {
+		build.Files = filepath.Join(namespace, name, commit)
+	}
+	dir := filepath.Join(STORAGE, build.Files)
+	if err := os.MkdirAll(dir, os.FileMode(DIRPERM)); err != nil {
+		end(500, fmt.Sprintf("Couldn't create directory: %s", err), gc)
+		return
+	}
+	// The new site is written alongside, then swapped in, so the old one is served until it's complete.
+	tmp, err := os.MkdirTemp(dir, uploadTmpPrefix)
+	if err != nil {
+		end(500, fmt.Sprintf("Couldn't create directory: %s", err), gc)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	site := filepath.Join(tmp, "site")
+	limits := &extractLimits{}
+	for fname, file := range form.File {
+		if len(form.File) == 1 && strings.HasSuffix(strings.ToLower(file[0].Filename), ".zip") {
+			archive := filepath.Join(tmp, "site.zip")
+			if err := gc.SaveUploadedFile(file[0], archive); err != nil {
+				end(500, fmt.Sprintf("Couldn't store file: %s", err), gc)
+				return
+			}
+			if err := extractZip(archive, site, limits); err != nil {
+				end(400, fmt.Sprintf("Couldn't extract archive: %s", err), gc)
+				return
+			}
+			break
+		}
+		f, err := file[0].Open()
+		if err != nil {
+			end(400, fmt.Sprintf("Couldn't read file: %s", err), gc)
+			return
+		}
+		err = limits.writeFile(site, fname, f)
+		f.Close()
+		if err != nil {
+			end(400, fmt.Sprintf("Couldn't store file: %s", err), gc)
+			return
+		}
+	}
+	if err := os.MkdirAll(site, os.FileMode(DIRPERM)); err != nil {
+		end(500, fmt.Sprintf("Couldn't create directory: %s", err), gc)
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(dir, siteDir)); err != nil {
+		end(500, fmt.Sprintf("Couldn't remove old preview: %s", err), gc)
+		return
+	}
+	if err := os.Rename(site, filepath.Join(dir, siteDir)); err != nil {
+		end(500, fmt.Sprintf("Couldn't store preview: %s", err), gc)
+		return
+	}
+	build.DateChanged = time.Now()
+	build.countSize()
+	repo.Builds[commit] = build
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s (%s): Stored preview of %d files", namespace, name, commit, limits.files)
+	gc.JSON(200, map[string]string{"url": previewURL(gc, namespace, name, commit)})
+}
+
+// GetPreview serves a file from a build's preview. Directories are served their index.html, and paths without an extension
+// fall back to <path>.html. If nothing's found, the site's own 404.html is used if it has one.
+func (app *appContext) GetPreview(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("commit")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	token, reqPath := previewPathToken(gc.Param("path"))
+	u, err := url.Parse(PREVIEW_URL)
+	elsewhere := PREVIEW_URL != "" && err == nil && !strings.EqualFold(gc.Request.Host, u.Host)
+	if elsewhere || (repo.Private && token == "") {
+		target := fmt.Sprintf("%s/preview/%s/%s/%s", PREVIEW_URL, url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(commit))
+		if repo.Private {
+			// The session doesn't reach a sandboxed page, so a short-lived read token is put in the path instead.
+			if token == "" {
+				token = gc.Query("token")
+			}
+			if token == "" {
+				if token, err = app.previewToken(namespace, name); err != nil {
+					end(500, fmt.Sprintf("Couldn't generate token: %s", err), gc)
+					return
+				}
+			}
+			target += "/" + previewTokenSegment + "/" + url.PathEscape(token)
+		}
+		if !elsewhere {
+			target = strings.TrimPrefix(target, PREVIEW_URL)
+		}
+		gc.Redirect(302, target+(&url.URL{Path: reqPath}).EscapedPath())
+		return
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, "Build not found", gc)
+		return
+	}
+	if !hasPreview(build) {
+		end(404, "No preview uploaded for this build", gc)
+		return
+	}
+	if !allowYankedDownload(gc, build) {
+		return
+	}
+	gc.Header("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads")
+	// Keeps a read token in the path from leaking to sites the preview links to.
+	gc.Header("Referrer-Policy", "no-referrer")
+	gc.Header("X-Content-Type-Options", "nosniff")
+	gc.Header("Cache-Control", "no-cache")
+	root := filepath.Join(STORAGE, build.Files, siteDir)
+	// Cleaning from the root means ".." can't climb out of the site.
+	target := filepath.Join(root, filepath.FromSlash(path.Clean("/"+reqPath)))
+	info, err := os.Stat(target)
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(reqPath, "/") {
+			// Relative links in the index resolve from the directory, so it needs the trailing slash.
+			gc.Redirect(301, gc.Request.URL.EscapedPath()+"/")
+			return
+		}
+		target = filepath.Join(target, "index.html")
+		info, err = os.Stat(target)
+	} else if err != nil && filepath.Ext(target) == "" {
+		target += ".html"
+		info, err = os.Stat(target)
+	}
+	if err != nil || info.IsDir() {
+		if page, err := os.ReadFile(filepath.Join(root, "404.html")); err == nil {
+			gc.Data(404, "text/html; charset=utf-8", page)
+			return
+		}
+		end(404, "Not found", gc)
+		return
+	}
+	gc.File(target)
+}
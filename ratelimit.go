@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	TRUSTED_PROXIES    []*net.IPNet // Requests from these may set X-Forwarded-For/X-Real-Ip. If empty, neither is trusted.
+	DOWNLOAD_BANDWIDTH uint64       // Most bytes per second sent to each download. 0 for no limit.
+)
+
+// rateLimit allows Burst requests at once, refilling at Rate a second.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseRate reads a limit like "60/m": 60 requests a minute, all of which can be made at once. The period is s, m or h.
+// Blank means no limit.
+func parseRate(s string) (*rateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 || len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate \"%s\"", s)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[strings.ToLower(strings.TrimSpace(parts[1]))]
+	if !ok {
+		return nil, fmt.Errorf("invalid rate period \"%s\"", parts[1])
+	}
+	return &rateLimit{Rate: n / period.Seconds(), Burst: n}, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client IP for one group of routes.
+type rateLimiter struct {
+	name    string
+	limit   *rateLimit
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(name string, limit *rateLimit) *rateLimiter {
+	l := &rateLimiter{name: name, limit: limit, buckets: map[string]*bucket{}}
+	if limit != nil {
+		go l.prune()
+	}
+	return l
+}
+
+// allow takes a token from ip's bucket, or returns how long until one's available.
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.limit.Burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+// prune drops buckets that have refilled, as they're no different from a new one.
+func (l *rateLimiter) prune() {
+	for {
+		time.Sleep(time.Minute)
+		l.lock.Lock()
+		for ip, b := range l.buckets {
+			if b.tokens+time.Since(b.last).Seconds()*l.limit.Rate >= l.limit.Burst {
+				delete(l.buckets, ip)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+// middleware refuses requests over the limit with 429 and a Retry-After in seconds.
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if l.limit == nil {
+			return
+		}
+		ok, wait := l.allow(gc.ClientIP())
+		if ok {
+			return
+		}
+		retry := int(math.Ceil(wait.Seconds()))
+		gc.Header("Retry-After", strconv.Itoa(retry))
+		log.Printf("Rate limited %s on %s (%s)", gc.ClientIP(), l.name, gc.Request.URL.Path)
+		abort(429, fmt.Sprintf("Too many requests, try again in %ds", retry), gc)
+	}
+}
+
+// parseTrustedProxies reads a comma separated list of IPs and CIDR ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP \"%s\"", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, n := range TRUSTED_PROXIES {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP is middleware replacing the request's remote address with the client's, as given by X-Forwarded-For or X-Real-Ip,
+// but only when it came from a trusted proxy. X-Forwarded-For is read from the right, skipping proxies, so a client can't
+// spoof its address by sending the header itself. Gin is set not to read these headers, so ClientIP then gives the result.
+func realIP() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(gc.Request.RemoteAddr))
+		if err != nil || !trustedProxy(net.ParseIP(host)) {
+			return
+		}
+		client := ""
+		if xff := gc.GetHeader("X-Forwarded-For"); xff != "" {
+			hops := strings.Split(xff, ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[i]))
+				if ip == nil {
+					break
+				}
+				client = ip.String()
+				if !trustedProxy(ip) {
+					break
+				}
+			}
+		}
+		if client == "" {
+			if ip := net.ParseIP(strings.TrimSpace(gc.GetHeader("X-Real-Ip"))); ip != nil {
+				client = ip.String()
+			}
+		}
+		if client != "" {
+			gc.Request.RemoteAddr = net.JoinHostPort(client, port)
+		}
+	}
+}
+
+// throttledWriter caps how fast a response is sent, sleeping between small writes to keep to rate bytes a second.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate    float64
+	start   time.Time
+	written int64
+}
+
+func throttle(w http.ResponseWriter) http.ResponseWriter {
+	if DOWNLOAD_BANDWIDTH == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, rate: float64(DOWNLOAD_BANDWIDTH), start: time.Now()}
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	// A tenth of a second's worth at a time keeps the rate smooth.
+	chunk := int(w.rate / 10)
+	if chunk < 1024 {
+		chunk = 1024
+	}
+	total := 0
+	for len(p) > 0 {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+		written, err := w.ResponseWriter.Write(p[:n])
+		total += written
+		w.written += int64(written)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		due := time.Duration(float64(w.written) / w.rate * float64(time.Second))
+		if wait := due - time.Since(w.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return total, nil
+}
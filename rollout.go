@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rollout stages a tag so only a percentage of clients are served it, picked by hashing their client ID.
+type Rollout struct {
+	Percent int  `json:"percent"`          // 1-99 for a partial rollout. 100 serves everyone.
+	Paused  bool `json:"paused,omitempty"` // Percent is frozen, so build uploads can't raise it until resumed.
+	Halted  bool `json:"halted,omitempty"` // Served to nobody, so clients stay on (or get) the previous version.
+}
+
+// rolloutBucket places a client in 0-99 for a tag version. The version is included so each release gets a different group of early clients.
+func rolloutBucket(tagName, version, client string) int {
+	h := fnv.New32a()
+	h.Write([]byte(tagName + "\x00" + version + "\x00" + client))
+	return int(h.Sum32() % 100)
+}
+
+// servedTo reports whether a client should be given this tag. Clients without an ID only get a tag once fully rolled out.
+func (t Tag) servedTo(tagName, client string) bool {
+	if t.Rollout == nil {
+		return true
+	}
+	if t.Rollout.Halted {
+		return false
+	}
+	if t.Rollout.Percent >= 100 {
+		return true
+	}
+	if client == "" {
+		return false
+	}
+	return rolloutBucket(tagName, t.Version, client) < t.Rollout.Percent
+}
+
+type RolloutReqDTO struct {
+	Commit  string
+	Percent *int  // Omit to leave unchanged.
+	Paused  *bool // Omit to leave unchanged.
+	Halted  *bool // Omit to leave unchanged.
+}
+
+// SetRollout raises, pauses, halts or resumes the rollout of a build's tag.
+func (app *appContext) SetRollout(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	tagName := gc.Param("tag")
+	var req RolloutReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	build, ok := repo.Builds[req.Commit]
+	if !ok {
+		end(400, fmt.Sprintf("Commit not found: %s", req.Commit), gc)
+		return
+	}
+	tag, ok := build.Tags[tagName]
+	if !ok {
+		end(404, fmt.Sprintf("Tag \"%s\" not found on commit %s", tagName, req.Commit), gc)
+		return
+	}
+	rollout := Rollout{Percent: 100}
+	if tag.Rollout != nil {
+		rollout = *tag.Rollout
+	}
+	if req.Percent != nil {
+		if *req.Percent < 0 || *req.Percent > 100 {
+			end(400, "Percent must be between 0 and 100", gc)
+			return
+		}
+		rollout.Percent = *req.Percent
+	}
+	if req.Paused != nil {
+		rollout.Paused = *req.Paused
+	}
+	if req.Halted != nil {
+		rollout.Halted = *req.Halted
+	}
+	tag.Rollout = &rollout
+	build.Tags[tagName] = tag
+	repo.Builds[req.Commit] = build
+	repo.recomputeLatestTag(tagName)
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s: Rollout of tag \"%s\" on %s: %d%%, paused %t, halted %t", namespace, name, tagName, req.Commit, rollout.Percent, rollout.Paused, rollout.Halted)
+	gc.JSON(200, rollout)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version. Build metadata is dropped as it doesn't affect precedence.
+type semver struct {
+	major, minor, patch uint64
+	pre                 []string
+}
+
+// parseSemver parses versions like "1.2.3", "v1.2.3-beta.1" or "1.2" (missing parts are 0).
+func parseSemver(s string) (v semver, ok bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "v"), "V")
+	if i := strings.IndexByte(s, '+'); i != -1 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		if i == len(s)-1 {
+			return
+		}
+		v.pre = strings.Split(s[i+1:], ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return
+			}
+		}
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return
+	}
+	nums := [3]uint64{}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	ok = true
+	return
+}
+
+func (v semver) prerelease() bool { return len(v.pre) != 0 }
+
+// compare returns -1, 0 or 1 following semver precedence rules.
+func (v semver) compare(o semver) int {
+	for _, c := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A pre-release is lower than its release.
+	if !v.prerelease() || !o.prerelease() {
+		if v.prerelease() {
+			return -1
+		}
+		if o.prerelease() {
+			return 1
+		}
+		return 0
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := compareIdentifier(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifier compares pre-release identifiers: numbers numerically, and lower than anything alphanumeric.
+func compareIdentifier(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
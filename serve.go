@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveBuildFile sends a file from a build, with a strong ETag from its SHA-256.
+// Files can be replaced by a later upload to the same commit, and yanked builds blocked, so caches must revalidate, which the ETag makes cheap.
+// If the client accepts a precompressed variant of the file, that's sent instead with its own ETag.
+// Range and conditional requests are handled by http.ServeContent.
+func (app *appContext) serveBuildFile(gc *gin.Context, build Build, fname string) {
+	path, ok := buildFilePath(build, fname)
+	if !ok {
+		end(400, fmt.Sprintf("Invalid file name: %s", fname), gc)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		end(400, fmt.Sprintf("File not found: %s", filepath.Join(build.Files, fname)), gc)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		end(400, fmt.Sprintf("File not found: %s", filepath.Join(build.Files, fname)), gc)
+		return
+	}
+	etag := ""
+	if sum, err := app.hashes.sum(path); err == nil {
+		etag = sum
+	}
+	var content io.ReadSeeker = f
+	variant, enc, hasVariants := precompressedVariant(path, info, gc.GetHeader("Accept-Encoding"))
+	if hasVariants {
+		gc.Header("Vary", "Accept-Encoding")
+	}
+	if variant != "" {
+		if vf, err := os.Open(variant); err == nil {
+			defer vf.Close()
+			content = vf
+			// ServeContent would sniff the compressed data, so the type is found from the original.
+			contentType := mime.TypeByExtension(filepath.Ext(fname))
+			if contentType == "" {
+				buf := make([]byte, 512)
+				n, _ := io.ReadFull(f, buf)
+				contentType = http.DetectContentType(buf[:n])
+			}
+			gc.Header("Content-Type", contentType)
+			gc.Header("Content-Encoding", enc.name)
+			if etag != "" {
+				etag += "-" + enc.name
+			}
+		}
+	}
+	if etag != "" {
+		gc.Header("ETag", `"`+etag+`"`)
+	}
+	if gc.GetBool("private") {
+		gc.Header("Cache-Control", "private, no-cache")
+	} else {
+		gc.Header("Cache-Control", "public, no-cache")
+	}
+	http.ServeContent(throttle(gc.Writer), gc.Request, fname, info.ModTime(), content)
+}
+
+// redirectToFile sends a client from a "latest" URL to the permanent one for the file it resolved to.
+// The redirect itself isn't cached, as it changes with each build.
+func redirectToFile(gc *gin.Context, namespace, name, commit, fname string) {
+	gc.Header("Cache-Control", "no-cache")
+	gc.Redirect(302, fileURL(gc, namespace, name, commit, fname))
+}
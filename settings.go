@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RepoSettingsDTO holds the per-repo options editable by an admin.
+type RepoSettingsDTO struct {
+	DefaultBranch string         // Branch the plain /latest endpoints serve from. Blank for the newest build on any branch.
+	PlatformRules []PlatformRule // Classify files by OS, arch and type for /latest/download. Tried in order before the defaults.
+	Precompress   bool           // Make gzip and zstd copies of new uploads.
+	Private       bool           // Hide the repo from anyone without a web session or read token.
+}
+
+func (app *appContext) getRepoSettings(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	gc.JSON(200, RepoSettingsDTO{
+		DefaultBranch: repo.DefaultBranch,
+		PlatformRules: repo.PlatformRules,
+		Precompress:   repo.Precompress,
+		Private:       repo.Private,
+	})
+}
+
+func (app *appContext) setRepoSettings(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	var req RepoSettingsDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	if req.DefaultBranch != "" && !containsString(repo.Branches, req.DefaultBranch) {
+		end(400, fmt.Sprintf("Branch not found: %s", req.DefaultBranch), gc)
+		return
+	}
+	if _, err := compilePlatformRules(req.PlatformRules); err != nil {
+		end(400, err.Error(), gc)
+		return
+	}
+	repo.DefaultBranch = req.DefaultBranch
+	repo.PlatformRules = req.PlatformRules
+	repo.Precompress = req.Precompress
+	repo.Private = req.Private
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s: Updated settings", namespace, name)
+	gc.JSON(200, req)
+}
@@ -6,7 +6,13 @@ parser.add_argument("url", help="url of buildrone instance")
 parser.add_argument("namespace", help="namespace of repo (usually account's username)")
 parser.add_argument("repo", help="name of repo")
 parser.add_argument("--upload", help="files to upload", nargs="+")
+parser.add_argument("--extract", action="store_true", help="unpack uploaded .zip/.tar.gz archives into the commit, keeping their directory structure.")
+parser.add_argument("--keep-archive", action="store_true", help="with --extract, store the archive as well as its contents.")
 parser.add_argument("--tag", help="<tagname>=<true>|<false>")
+parser.add_argument("--site", help="directory or .zip of a static site to publish as the commit's preview.")
+parser.add_argument("--notes", help="markdown file of release notes, stored on the tag if --tag is given, or the commit otherwise.")
+parser.add_argument("--rollout", type=int, help="with --tag, percentage of clients to roll the version out to at first.")
+parser.add_argument("--min-version", help="with --tag, oldest version still supported. Clients below it are told they must update.")
 
 args = parser.parse_args()
 
@@ -50,7 +56,12 @@ def upload(filenames, namespace, repo, commit):
                 handlers.append(f)
         url = f"{args.url}/repo/{namespace}/{repo}/commit/{commit}/add"
         print(url)
-        req = requests.post(url, headers=tokenHeader, files=files)
+        params = {}
+        if args.extract:
+            params["extract"] = "true"
+            if args.keep_archive:
+                params["keep"] = "true"
+        req = requests.post(url, headers=tokenHeader, files=files, params=params)
         print(f"Status {req}")
     finally:
         for h in handlers:
@@ -59,10 +70,15 @@ def upload(filenames, namespace, repo, commit):
 
 def tag(namespace, repo, commit, tagName, ready):
     version = commit
+    data = {"ready": ready, "version": version, "date": str(int(time.time()))}
+    if args.min_version:
+        data["min_version"] = args.min_version
+    if args.rollout is not None:
+        data["rollout"] = {"percent": args.rollout}
     req = requests.post(
         f"{args.url}/repo/{namespace}/{repo}/commit/{commit}/tag/{tagName}",
         headers=tokenHeader,
-        json={"ready": ready, "version": version, "date": str(int(time.time()))},
+        json=data,
     )
     print(f"Status {req}")
 
@@ -85,3 +101,41 @@ if args.tag:
     if stateStr == "true":
         state = True
     tag(args.namespace, args.repo, commit, tagName, state)
+
+if args.notes:
+    url = f"{args.url}/repo/{args.namespace}/{args.repo}/commit/{commit}/notes"
+    if args.tag:
+        url += "/" + args.tag.split("=")[0]
+    with open(args.notes, "rb") as f:
+        req = requests.post(
+            url,
+            headers={**tokenHeader, "Content-Type": "text/markdown"},
+            data=f.read(),
+        )
+    print(f"Status {req}")
+
+if args.site:
+    handlers = []
+    try:
+        files = {}
+        if os.path.isdir(args.site):
+            for path in sorted(Path(args.site).rglob("*")):
+                if path.is_file():
+                    f = open(path, "rb")
+                    files[path.relative_to(args.site).as_posix()] = f
+                    handlers.append(f)
+        else:
+            f = open(args.site, "rb")
+            files[Path(args.site).name] = f
+            handlers.append(f)
+        req = requests.post(
+            f"{args.url}/repo/{args.namespace}/{args.repo}/commit/{commit}/site",
+            headers=tokenHeader,
+            files=files,
+        )
+        print(f"Status {req}")
+        if req.status_code == 200:
+            print(f"Preview at {req.json()['url']}")
+    finally:
+        for h in handlers:
+            h.close()
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	statsFile = "stats.gob"
+	dayFormat = "2006-01-02"
+)
+
+var STATS_DAYS = 365 // Days of download statistics kept.
+
+// RepoDayStats counts a repo's downloads on one day (UTC).
+type RepoDayStats struct {
+	Downloads int
+	Files     map[string]int // map[commit/file]
+	Builds    map[string]int // map[commit], including whole-build archives.
+	TagChecks map[string]int // map[tag or channel], from the tag and update endpoints.
+	Visitors  int            // Unique visitors, filled in from VisitorHashes once the day's over.
+	// Salted hashes of today's visitors' IPs. The salt is replaced and these are dropped when the day ends,
+	// so no record is kept that could match an IP to past downloads.
+	VisitorHashes map[uint64]bool
+}
+
+func (s *RepoDayStats) visitors() int {
+	if s.VisitorHashes != nil {
+		return len(s.VisitorHashes)
+	}
+	return s.Visitors
+}
+
+// statsStore holds download counts, kept in stats.gob apart from storage.gob as they change with every download.
+type statsStore struct {
+	lock  sync.Mutex
+	Days  map[string]map[string]*RepoDayStats // map[day]map[namespace/name]
+	dirty bool
+	// The salt for visitor hashes is only kept in memory, so stats.gob can't be used to find which IPs made them.
+	// It's replaced on restart too, which may count a visitor twice that day.
+	salt    []byte
+	saltDay string
+}
+
+func (s *statsStore) load() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return readGob(statsFile, s)
+}
+
+// save writes stats.gob if anything's changed. It rolls over first, so past days' visitor hashes don't outlive the day on disk
+// even if nothing else has happened.
+func (s *statsStore) save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rollover()
+	if !s.dirty {
+		return nil
+	}
+	if err := writeGob(statsFile, s); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// rollover replaces the salt when the day changes, turns past days' visitor hashes into counts, and drops days older than STATS_DAYS.
+// The lock must be held.
+func (s *statsStore) rollover() {
+	today := time.Now().UTC().Format(dayFormat)
+	if s.saltDay != today || len(s.salt) == 0 {
+		s.salt = make([]byte, 32)
+		rand.Read(s.salt)
+		s.saltDay = today
+	}
+	oldest := time.Now().UTC().AddDate(0, 0, -STATS_DAYS).Format(dayFormat)
+	for day, repos := range s.Days {
+		if day < oldest {
+			delete(s.Days, day)
+			s.dirty = true
+			continue
+		}
+		if day == today {
+			continue
+		}
+		for _, r := range repos {
+			if r.VisitorHashes != nil {
+				r.Visitors = len(r.VisitorHashes)
+				r.VisitorHashes = nil
+				s.dirty = true
+			}
+		}
+	}
+}
+
+// day returns today's counts for a repo, creating them if needed. The lock must be held.
+func (s *statsStore) day(id string) *RepoDayStats {
+	s.rollover()
+	if s.Days == nil {
+		s.Days = map[string]map[string]*RepoDayStats{}
+	}
+	today := time.Now().UTC().Format(dayFormat)
+	if s.Days[today] == nil {
+		s.Days[today] = map[string]*RepoDayStats{}
+	}
+	r, ok := s.Days[today][id]
+	if !ok {
+		r = &RepoDayStats{Files: map[string]int{}, Builds: map[string]int{}, TagChecks: map[string]int{}, VisitorHashes: map[uint64]bool{}}
+		s.Days[today][id] = r
+	}
+	s.dirty = true
+	return r
+}
+
+func (s *statsStore) visit(r *RepoDayStats, ip string) {
+	sum := sha256.Sum256(append(append([]byte{}, s.salt...), ip...))
+	r.VisitorHashes[binary.BigEndian.Uint64(sum[:8])] = true
+}
+
+// countable reports whether a request is a new download, rather than a HEAD or a range request resuming one.
+func countable(gc *gin.Context) bool {
+	if gc.Request.Method != http.MethodGet {
+		return false
+	}
+	r := gc.GetHeader("Range")
+	return r == "" || strings.HasPrefix(r, "bytes=0-")
+}
+
+// recordDownload counts a download of a file from a build, or the whole build if fname is blank.
+func (app *appContext) recordDownload(gc *gin.Context, namespace, name, commit, fname string) {
+	if !countable(gc) || gc.Writer.Status() >= 300 {
+		return
+	}
+	ip := gc.ClientIP()
+	app.stats.lock.Lock()
+	r := app.stats.day(namespace + "/" + name)
+	r.Downloads++
+	r.Builds[commit]++
+	if fname != "" {
+		r.Files[commit+"/"+fname]++
+	}
+	app.stats.visit(r, ip)
+	app.stats.lock.Unlock()
+	go app.logIP(ip)
+}
+
+// recordTagCheck counts a client checking for the latest version of a tag or channel.
+func (app *appContext) recordTagCheck(gc *gin.Context, namespace, name, tag string) {
+	ip := gc.ClientIP()
+	app.stats.lock.Lock()
+	r := app.stats.day(namespace + "/" + name)
+	r.TagChecks[tag]++
+	app.stats.visit(r, ip)
+	app.stats.lock.Unlock()
+	go app.logIP(ip)
+}
+
+// statsSaver writes stats to disk every minute, so at most a minute's counts are lost on a crash, and rolls them over when the day ends.
+func (app *appContext) statsSaver() {
+	for {
+		time.Sleep(time.Minute)
+		if err := app.stats.save(); err != nil {
+			log.Printf("Couldn't store stats: %s", err)
+		}
+	}
+}
+
+var logIPClient = &http.Client{Timeout: 10 * time.Second}
+
+// logIP sends a visitor's IP to the external logger set by user_log, if any.
+func (app *appContext) logIP(ip string) {
+	if !LOGIPS {
+		return
+	}
+	resp, err := logIPClient.Get(app.logTo + ip)
+	if err != nil {
+		log.Printf("Couldn't log IP: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+type DayStatsDTO struct {
+	Date      string
+	Downloads int
+	Visitors  int // Unique that day.
+	TagChecks int
+}
+
+type CountDTO struct {
+	Name  string
+	Count int
+}
+
+type RepoStatsDTO struct {
+	Namespace string `json:",omitempty"`
+	Name      string `json:",omitempty"`
+	Downloads int
+	Visitors  int // Sum of each day's unique visitors.
+	TagChecks int
+	Days      []DayStatsDTO `json:",omitempty"` // Oldest first.
+	Files     []CountDTO    `json:",omitempty"` // Most downloaded first.
+	Builds    []CountDTO    `json:",omitempty"`
+	Tags      []CountDTO    `json:",omitempty"`
+}
+
+func sortedCounts(counts map[string]int) []CountDTO {
+	out := make([]CountDTO, 0, len(counts))
+	for name, count := range counts {
+		out = append(out, CountDTO{name, count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// statsRange parses ?days (default 30) into the first day to include.
+func statsRange(gc *gin.Context) (string, bool) {
+	days, err := strconv.Atoi(gc.DefaultQuery("days", "30"))
+	if err != nil || days < 1 {
+		end(400, "Invalid number of days", gc)
+		return "", false
+	}
+	return time.Now().UTC().AddDate(0, 0, 1-days).Format(dayFormat), true
+}
+
+// getRepoStats summarises a repo's downloads over the last ?days days: daily totals, and the most downloaded files, builds and tags.
+func (app *appContext) getRepoStats(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	if _, ok := app.storage[namespace+"/"+name]; !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	from, ok := statsRange(gc)
+	if !ok {
+		return
+	}
+	resp := RepoStatsDTO{Days: []DayStatsDTO{}}
+	files, builds, tags := map[string]int{}, map[string]int{}, map[string]int{}
+	app.stats.lock.Lock()
+	for day, repos := range app.stats.Days {
+		r, ok := repos[namespace+"/"+name]
+		if day < from || !ok {
+			continue
+		}
+		d := DayStatsDTO{Date: day, Downloads: r.Downloads, Visitors: r.visitors()}
+		for k, v := range r.Files {
+			files[k] += v
+		}
+		for k, v := range r.Builds {
+			builds[k] += v
+		}
+		for k, v := range r.TagChecks {
+			tags[k] += v
+			d.TagChecks += v
+		}
+		resp.Downloads += d.Downloads
+		resp.Visitors += d.Visitors
+		resp.TagChecks += d.TagChecks
+		resp.Days = append(resp.Days, d)
+	}
+	app.stats.lock.Unlock()
+	sort.Slice(resp.Days, func(i, j int) bool { return resp.Days[i].Date < resp.Days[j].Date })
+	resp.Files, resp.Builds, resp.Tags = sortedCounts(files), sortedCounts(builds), sortedCounts(tags)
+	gc.JSON(200, resp)
+}
+
+// getStats gives each repo's totals over the last ?days days, most downloaded first.
+func (app *appContext) getStats(gc *gin.Context) {
+	from, ok := statsRange(gc)
+	if !ok {
+		return
+	}
+	totals := map[string]*RepoStatsDTO{}
+	app.stats.lock.Lock()
+	for day, repos := range app.stats.Days {
+		if day < from {
+			continue
+		}
+		for id, r := range repos {
+			t, ok := totals[id]
+			if !ok {
+				parts := strings.SplitN(id, "/", 2)
+				t = &RepoStatsDTO{Namespace: parts[0], Name: parts[1]}
+				totals[id] = t
+			}
+			t.Downloads += r.Downloads
+			t.Visitors += r.visitors()
+			for _, v := range r.TagChecks {
+				t.TagChecks += v
+			}
+		}
+	}
+	app.stats.lock.Unlock()
+	resp := []RepoStatsDTO{}
+	for _, t := range totals {
+		resp = append(resp, *t)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Downloads != resp[j].Downloads {
+			return resp[i].Downloads > resp[j].Downloads
+		}
+		return resp[i].Namespace+"/"+resp[i].Name < resp[j].Namespace+"/"+resp[j].Name
+	})
+	gc.JSON(200, resp)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	storageFile    = "storage.gob"
+	snapshotDir    = "snapshots"
+	snapshotPrefix = "storage-"
+	snapshotSuffix = ".gob"
+	// snapshotInterval is the least time between snapshots, so frequent stores (like each reload) don't push out every good copy
+	// before a problem's noticed.
+	snapshotInterval = time.Hour
+)
+
+// store writes storage to a temporary file, syncs it and renames it over storage.gob, so a crash never leaves a truncated database behind.
+// The previous storage.gob is kept as a snapshot at most once per snapshotInterval, with only the newest SNAPSHOTS kept.
+func (app *appContext) store() error {
+	app.storeLock.Lock()
+	defer app.storeLock.Unlock()
+	path := filepath.Join(DATADIR, storageFile)
+	tmp, err := os.CreateTemp(DATADIR, storageFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := gob.NewEncoder(tmp)
+	if err := enc.Encode(app.storage); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if SNAPSHOTS > 0 {
+		if err := snapshot(path); err != nil {
+			log.Printf("Couldn't snapshot storage: %s", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(DATADIR)
+	return nil
+}
+
+// read loads storage.gob, falling back to the newest snapshot that decodes if it is missing or corrupt.
+func (app *appContext) read() error {
+	path := filepath.Join(DATADIR, storageFile)
+	err := decodeStorage(path, &app.storage)
+	if err == nil {
+		return nil
+	}
+	snapshots, snapErr := listSnapshots()
+	if snapErr != nil || len(snapshots) == 0 {
+		return err
+	}
+	log.Printf("Couldn't read \"%s\": %s", path, err)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if sErr := decodeStorage(snapshots[i], &app.storage); sErr != nil {
+			log.Printf("Couldn't read snapshot \"%s\": %s", snapshots[i], sErr)
+			continue
+		}
+		log.Printf("Restored storage from snapshot \"%s\"", snapshots[i])
+		return nil
+	}
+	return fmt.Errorf("storage and all snapshots unreadable: %w", err)
+}
+
+// readGob decodes a file in DATADIR into v.
+func readGob(name string, v interface{}) error {
+	f, err := os.Open(filepath.Join(DATADIR, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(v)
+}
+
+// writeGob encodes v to a file in DATADIR through a temporary file renamed over it, so a crash never leaves it truncated.
+// Used for the smaller stores kept apart from storage.gob, which don't need its snapshots.
+func writeGob(name string, v interface{}) error {
+	tmp, err := os.CreateTemp(DATADIR, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(DATADIR, name))
+}
+
+// decodeStorage decodes into a fresh map so a partially decoded file doesn't leave junk in storage.
+func decodeStorage(path string, storage *map[string]Repo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := map[string]Repo{}
+	if err := gob.NewDecoder(file).Decode(&s); err != nil {
+		return err
+	}
+	*storage = s
+	return nil
+}
+
+// snapshot preserves the current storage file in the snapshot directory and removes the oldest ones beyond SNAPSHOTS.
+// Nothing's done if the newest snapshot is less than snapshotInterval old.
+func snapshot(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if snapshots, err := listSnapshots(); err == nil && len(snapshots) != 0 {
+		if t, ok := snapshotTime(snapshots[len(snapshots)-1]); ok && time.Since(t) < snapshotInterval {
+			return nil
+		}
+	}
+	dir := filepath.Join(DATADIR, snapshotDir)
+	if err := os.MkdirAll(dir, os.FileMode(DIRPERM)); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%s%d%s", snapshotPrefix, time.Now().UnixNano(), snapshotSuffix))
+	// The old file is about to be replaced by rename, so a hard link is enough.
+	if err := os.Link(path, dst); err != nil {
+		if err := copyFile(path, dst); err != nil {
+			return err
+		}
+	}
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > SNAPSHOTS {
+		os.Remove(snapshots[0])
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// snapshotTime reads when a snapshot was taken from its name.
+func snapshotTime(path string) (time.Time, bool) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), snapshotPrefix), snapshotSuffix)
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// listSnapshots returns snapshot paths, oldest first.
+func listSnapshots() ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(DATADIR, snapshotDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []string
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), snapshotPrefix) || !strings.HasSuffix(f.Name(), snapshotSuffix) {
+			continue
+		}
+		snapshots = append(snapshots, filepath.Join(DATADIR, snapshotDir, f.Name()))
+	}
+	// Names are timestamped with a fixed-width UnixNano, so lexical order is chronological.
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes a directory entry so a rename survives a crash. Errors are ignored as not all platforms support it.
+func syncDir(path string) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tagEntry is one build's copy of a tag.
+type tagEntry struct {
+	commit   string
+	build    Build
+	tag      Tag
+	semver   semver
+	isSemver bool
+}
+
+func (e tagEntry) date() time.Time {
+	if !e.tag.ReleaseDate.IsZero() {
+		return e.tag.ReleaseDate.Time
+	}
+	return e.build.Date
+}
+
+// less reports whether e is an older version than o.
+// Semantic versions are compared by precedence and rank above anything else, which falls back to release date.
+func (e tagEntry) less(o tagEntry) bool {
+	if e.isSemver && o.isSemver {
+		if c := e.semver.compare(o.semver); c != 0 {
+			return c < 0
+		}
+	} else if e.isSemver != o.isSemver {
+		return o.isSemver
+	}
+	return e.date().Before(o.date())
+}
+
+// tagHistory returns every build's copy of a tag, newest version first.
+func (repo Repo) tagHistory(tagName string) (entries []tagEntry) {
+	for commit, b := range repo.Builds {
+		tag, ok := b.Tags[tagName]
+		if !ok {
+			continue
+		}
+		e := tagEntry{
+			commit: commit,
+			build:  b,
+			tag:    tag,
+		}
+		e.semver, e.isSemver = parseSemver(tag.Version)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[j].less(entries[i]) })
+	return
+}
+
+// latestTag returns the highest ready version of a tag served to the given client, optionally ignoring pre-releases.
+// With no client, it's the version every client is served.
+func (repo Repo) latestTag(tagName string, prerelease bool, client string) (tagEntry, bool) {
+	for _, e := range repo.tagHistory(tagName) {
+		if !e.tag.Ready || e.build.Yanked || (!prerelease && e.semver.prerelease()) || !e.tag.servedTo(tagName, client) {
+			continue
+		}
+		return e, true
+	}
+	return tagEntry{}, false
+}
+
+type TagVersionDTO struct {
+	Commit      string
+	Branch      string
+	Version     string
+	Ready       bool
+	ReleaseDate Time
+	Semver      bool // Whether Version was parsed as a semantic version. If not, it's ordered by ReleaseDate below any that were.
+	Prerelease  bool
+	Rollout     *Rollout `json:",omitempty"`
+	Yanked      bool
+}
+
+// GetTagVersions lists every version of a tag, newest first.
+// ?prerelease=false excludes pre-releases, ?ready=true excludes tags not marked ready.
+func (app *appContext) GetTagVersions(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	tagName := gc.Param("tag")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	prerelease := gc.DefaultQuery("prerelease", "true") != "false"
+	readyOnly := gc.Query("ready") == "true"
+	resp := []TagVersionDTO{}
+	for _, e := range repo.tagHistory(tagName) {
+		if (readyOnly && !e.tag.Ready) || (!prerelease && e.semver.prerelease()) {
+			continue
+		}
+		resp = append(resp, e.dto())
+	}
+	gc.JSON(200, resp)
+}
+
+func (e tagEntry) dto() TagVersionDTO {
+	return TagVersionDTO{
+		Commit:      e.commit,
+		Branch:      e.build.Branch,
+		Version:     e.tag.Version,
+		Ready:       e.tag.Ready,
+		ReleaseDate: e.tag.ReleaseDate,
+		Semver:      e.isSemver,
+		Prerelease:  e.semver.prerelease(),
+		Rollout:     e.tag.Rollout,
+		Yanked:      e.build.Yanked,
+	}
+}
+
+// tagNames returns the name of every tag set on any build.
+func (repo Repo) tagNames() (names []string) {
+	seen := map[string]bool{}
+	for _, b := range repo.Builds {
+		for name := range b.Tags {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// recomputeLatestTag sets LatestTags[tagName] from the tag's history, rather than to whatever was set last.
+// If no version is served to every client, the newest is stored marked unready, so GetTag reports it as not ready
+// rather than leaking a halted or partial rollout. Yanked builds are never stored.
+func (repo *Repo) recomputeLatestTag(tagName string) {
+	if repo.LatestTags == nil {
+		repo.LatestTags = map[string]Tag{}
+	}
+	history := repo.tagHistory(tagName)
+	if e, ok := repo.latestTag(tagName, true, ""); ok {
+		repo.LatestTags[tagName] = e.tag
+		return
+	}
+	for _, e := range history {
+		if e.build.Yanked {
+			continue
+		}
+		tag := e.tag
+		tag.Ready = false
+		repo.LatestTags[tagName] = tag
+		return
+	}
+	delete(repo.LatestTags, tagName)
+}
+
+type TagHistoryDTO struct {
+	Latest  *TagVersionDTO  // Version served by GetTag's "latest" to every client, nil if none are ready.
+	History []TagVersionDTO // Newest version first.
+}
+
+// GetTags lists every tag on a repo with its history.
+func (app *appContext) GetTags(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	resp := map[string]TagHistoryDTO{}
+	for _, tagName := range repo.tagNames() {
+		h := TagHistoryDTO{History: []TagVersionDTO{}}
+		for _, e := range repo.tagHistory(tagName) {
+			h.History = append(h.History, e.dto())
+		}
+		if e, ok := repo.latestTag(tagName, true, ""); ok {
+			dto := e.dto()
+			h.Latest = &dto
+		}
+		resp[tagName] = h
+	}
+	gc.JSON(200, resp)
+}
+
+// DeleteTag removes a tag from every build, or just from the one given by :commit.
+func (app *appContext) DeleteTag(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	tagName := gc.Param("tag")
+	commit := gc.Param("commit")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	found := false
+	for c, b := range repo.Builds {
+		if commit != "" && c != commit {
+			continue
+		}
+		if _, ok := b.Tags[tagName]; ok {
+			delete(b.Tags, tagName)
+			found = true
+		}
+	}
+	if !found {
+		end(404, fmt.Sprintf("Tag not found: %s", tagName), gc)
+		return
+	}
+	if commit == "" {
+		delete(repo.LatestTags, tagName)
+		log.Printf("%s/%s: Deleted tag \"%s\"", namespace, name, tagName)
+	} else {
+		repo.recomputeLatestTag(tagName)
+		log.Printf("%s/%s: Deleted tag \"%s\" from %s", namespace, name, tagName, commit)
+	}
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	end(200, "Tag deleted", gc)
+}
+
+type RollbackTagReqDTO struct {
+	Commit string
+}
+
+// RollbackTag makes the tag on the given build the latest, by marking every higher version not ready.
+func (app *appContext) RollbackTag(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	tagName := gc.Param("tag")
+	var req RollbackTagReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	history := repo.tagHistory(tagName)
+	target := -1
+	for i, e := range history {
+		if e.commit == req.Commit {
+			target = i
+			break
+		}
+	}
+	if target == -1 {
+		end(404, fmt.Sprintf("Tag \"%s\" not found on commit %s", tagName, req.Commit), gc)
+		return
+	}
+	for i, e := range history[:target+1] {
+		e.tag.Ready = i == target
+		e.build.Tags[tagName] = e.tag
+	}
+	repo.recomputeLatestTag(tagName)
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	log.Printf("%s/%s: Rolled back tag \"%s\" to %s", namespace, name, tagName, req.Commit)
+	end(200, "Tag rolled back", gc)
+}
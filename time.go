@@ -11,7 +11,13 @@ type Time struct {
 }
 
 func (t *Time) UnmarshalJSON(b []byte) (err error) {
-	unix, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSuffix(string(b), "\""), "\""), 10, 64)
+	s := strings.TrimPrefix(strings.TrimSuffix(string(b), "\""), "\"")
+	// MarshalJSON writes the zero time as "".
+	if s == "" || s == "null" {
+		t.Time = time.Time{}
+		return
+	}
+	unix, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
 		return
 	}
@@ -65,6 +65,7 @@ interface Repo {
     LatestCommit: string;
     LatestPush: Build;
     Secret: boolean;
+    Size: number;
 }
 
 interface NewSecret {
@@ -84,6 +85,19 @@ interface File {
     Size: string;
 }
 
+const fileSize = (l: number): string => {
+    const unit = 1000;
+    if (l < unit) {
+        return `${l}B`;
+    }
+    let div = unit, exp = 0;
+    for (let n = l / unit; n >= unit; n /= unit) {
+        div *= unit;
+        exp++;
+    }
+    return `${(l / div).toFixed(1)}${"KMGTPE"[exp]}`;
+};
+
 const genCard = (repo: Repo): HTMLDivElement => {
     const hasBuilds = repo.LatestCommit != ""
     let shortCommit = '';
@@ -99,6 +113,7 @@ const genCard = (repo: Repo): HTMLDivElement => {
         if (hasBuilds) { 
             repoSection += `<a href="${repo.LatestPush.Link}" class="card-title h5 text-monospace text-gray">${shortCommit}</a>
             <div class="card-subtitle text-gray">Last commit: ${repo.LatestPush.Date.toLocaleDateString('en-US')} @ ${repo.LatestPush.Date.toLocaleTimeString('en-US')}</div>
+            <div class="card-subtitle text-gray">Storage used: ${fileSize(repo.Size)}</div>
             `;
         } else {
             repoSection += `<div class="card-subtitle text-gray">No commits yet.</div>`;
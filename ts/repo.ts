@@ -46,6 +46,10 @@ interface Build {
     Files: File[];
     Link: string;
     Branch: string;
+    Yanked: boolean;
+    YankReason: string;
+    Notes: string;
+    Preview: string;
 }
 
 interface File {
@@ -57,12 +61,19 @@ const base = window.location.href.split("/view")[0];
 const title: Array<string> = document.title.split("/");
 const namespace = title[0];
 const repoName = title[1];
+// A read token for a private repo, passed on to everything the page loads.
+const readToken = new URLSearchParams(window.location.search).get("token");
+const tokenQuery = readToken ? `?token=${encodeURIComponent(readToken)}` : "";
 
 class BuildCard implements Build {
     private _card: HTMLDivElement;
     ID: number;
     Branch: string;
+    private _yanked: boolean;
+    YankReason: string;
     private _files: File[];
+    private _notes: string;
+    private _preview: string;
     private _commit: string;
     private _commitLink: HTMLAnchorElement;
     private _buildPrefix: string;
@@ -88,6 +99,39 @@ class BuildCard implements Build {
         dateEl.textContent = `${d.toLocaleDateString(locale)} @ ${d.toLocaleTimeString(locale)}`;
     }
 
+    get Yanked(): boolean { return this._yanked; }
+    set Yanked(y: boolean) {
+        this._yanked = y;
+        const yankedEl = this._card.querySelector(".build-yanked") as HTMLDivElement;
+        if (y) {
+            yankedEl.textContent = this.YankReason ? `Yanked: ${this.YankReason}` : "Yanked";
+            yankedEl.style.display = "";
+        } else {
+            yankedEl.style.display = "none";
+        }
+    }
+
+    get Preview(): string { return this._preview; }
+    set Preview(p: string) {
+        this._preview = p;
+        const previewEl = this._card.querySelector(".build-preview") as HTMLAnchorElement;
+        if (p) {
+            previewEl.href = p + tokenQuery;
+            previewEl.style.display = "";
+        } else {
+            previewEl.style.display = "none";
+        }
+    }
+
+    // Notes is HTML sanitised by the server.
+    get Notes(): string { return this._notes; }
+    set Notes(n: string) {
+        this._notes = n;
+        const notesEl = this._card.querySelector(".build-notes") as HTMLDivElement;
+        notesEl.innerHTML = n;
+        notesEl.style.display = n ? "" : "none";
+    }
+
     get Files(): File[] { return this._files; }
     set Files(f: File[]) {
         const dropdown = this._card.querySelector("input.build-dropdown") as HTMLInputElement;
@@ -100,7 +144,7 @@ class BuildCard implements Build {
             for (let file of f) {
                 fileList += `
                 <li class="menu-item">
-                    <a href="${this._buildPrefix}/${file.Name}">${file.Name} <i class="menu-badge text-gray">${file.Size}</i></a>
+                    <a href="${this._buildPrefix}/${encodeURIComponent(file.Name)}${tokenQuery}">${file.Name} <i class="menu-badge text-gray">${file.Size}</i></a>
                 </li>
                 `;
             }
@@ -124,6 +168,8 @@ class BuildCard implements Build {
                         <a class="card-title h5 text-monospace build-commit"></a>
                         <div class="card-subtitle text-gray text-monospace build-name"></div>
                         <div class="card-subtitle text-gray build-date"></div>
+                        <div class="card-subtitle text-error build-yanked" style="display: none;"></div>
+                        <a class="card-subtitle build-preview" target="_blank" rel="noopener" style="display: none;">Preview site</a>
                     </div>
                 </div>
                 <div class="divider-vert"></div>
@@ -140,6 +186,7 @@ class BuildCard implements Build {
                             </div>
                         </div>
                         <p class="text-gray build-nofiles">No files published for this commit.</p>
+                        <div class="build-notes" style="display: none;"></div>
                     </div>
                 <div>
             </div>
@@ -153,6 +200,10 @@ class BuildCard implements Build {
         this.Files = build.Files;
         this.Link = build.Link;
         this.Branch = build.Branch;
+        this.YankReason = build.YankReason;
+        this.Yanked = build.Yanked;
+        this.Notes = build.Notes;
+        this.Preview = build.Preview;
     }
 
     asElement = (): HTMLDivElement => { return this._card; }
@@ -219,7 +270,7 @@ var repo: Repo;
 var buildOrder: string[] = [];
 var currentPage = 1;
 
-_get(`${base}/repo/${namespace}/${repoName}`, null, function (): void {
+_get(`${base}/repo/${namespace}/${repoName}${tokenQuery}`, null, function (): void {
     if (this.readyState == 4 && this.status == 200) {
         repo = this.response as Repo;
         repo.Builds = {};
@@ -247,7 +298,7 @@ interface BuildsDTO {
 var currentBranch: string = "";
 var branchTabs = new BranchTabs();
 
-const getPage = (page: number): void => _get(`${base}/repo/${namespace}/${repoName}/builds/${page}`, null, function (): void {
+const getPage = (page: number): void => _get(`${base}/repo/${namespace}/${repoName}/builds/${page}${tokenQuery}`, null, function (): void {
     if (this.readyState == 4) {
         const loadButton = document.getElementById('loadMore') as HTMLButtonElement;
         if (this.status == 200) {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publicURL returns the address buildrone is reachable at, from public_url if set or the request otherwise.
+func publicURL(gc *gin.Context) string {
+	if PUBLIC_URL != "" {
+		return PUBLIC_URL
+	}
+	scheme := "http"
+	if gc.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := gc.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + gc.Request.Host
+}
+
+// fileURL is the permanent download link for a file in a build.
+func fileURL(gc *gin.Context, namespace, name, commit, fname string) string {
+	u := fmt.Sprintf("%s/repo/%s/%s/build/%s/%s", publicURL(gc), url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(commit), url.PathEscape(fname))
+	// A read token for a private repo is passed on, so feeds and redirects given one keep working.
+	if token := gc.Query("token"); token != "" {
+		u += "?token=" + url.QueryEscape(token)
+	}
+	return u
+}
+
+// newerVersion reports whether latest is an update from current.
+// Semantic versions are compared properly, anything else is an update if it differs.
+func newerVersion(current, latest string) bool {
+	c, cOk := parseSemver(current)
+	l, lOk := parseSemver(latest)
+	if cOk && lOk {
+		return c.compare(l) < 0
+	}
+	return current != latest
+}
+
+type UpdateDTO struct {
+	Update      bool   // Whether there's a newer version than the one given.
+	Required    bool   // The given version is below the tag's minimum supported version.
+	Version     string `json:",omitempty"`
+	MinVersion  string `json:",omitempty"`
+	Commit      string `json:",omitempty"`
+	ReleaseDate Time
+	File        string `json:",omitempty"` // Empty if no platform was given, or no file matched it.
+	URL         string `json:",omitempty"`
+	Size        int64  `json:",omitempty"`
+	SHA256      string `json:",omitempty"`
+}
+
+// CheckUpdate tells a client whether there is an update for it.
+// Query: version (current version), channel (a channel, or a tag if there's no channel by that name; tag= is also accepted), platform (the OS, arch and/or type to pick a file for, e.g. "windows-x64"),
+// client (a stable, random ID for the installation, needed to be included in staged rollouts) and prerelease=false to ignore pre-releases.
+func (app *appContext) CheckUpdate(gc *gin.Context) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	current := gc.Query("version")
+	channel := gc.DefaultQuery("channel", gc.Query("tag"))
+	if channel == "" {
+		end(400, "No channel provided", gc)
+		return
+	}
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	defer app.recordTagCheck(gc, namespace, name, channel)
+	prerelease := gc.DefaultQuery("prerelease", "true") != "false"
+	var e tagEntry
+	if _, isChannel := repo.Channels[channel]; isChannel {
+		e, ok = repo.channelEntry(channel)
+		ok = ok && (prerelease || !e.semver.prerelease())
+	} else {
+		e, ok = repo.latestTag(channel, prerelease, gc.Query("client"))
+	}
+	if !ok {
+		gc.JSON(200, UpdateDTO{})
+		return
+	}
+	resp := UpdateDTO{
+		Update:      current == "" || newerVersion(current, e.tag.Version),
+		Version:     e.tag.Version,
+		MinVersion:  e.tag.MinVersion,
+		Commit:      e.commit,
+		ReleaseDate: e.tag.ReleaseDate,
+	}
+	if c, ok := parseSemver(current); ok {
+		if min, ok := parseSemver(e.tag.MinVersion); ok {
+			resp.Required = c.compare(min) < 0
+		}
+	}
+	if platform := gc.Query("platform"); platform != "" {
+		if fname, ok := repo.platformFile(e.build, platform); ok {
+			resp.File = fname
+			resp.URL = fileURL(gc, namespace, name, e.commit, fname)
+			if info, err := os.Stat(filepath.Join(STORAGE, e.build.Files, fname)); err == nil {
+				resp.Size = info.Size()
+			}
+			if sum, err := app.buildChecksum(e.build, fname); err == nil {
+				resp.SHA256 = sum
+			}
+		}
+	}
+	gc.JSON(200, resp)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dirSize returns the total size of regular files under dir, relative to STORAGE.
+func dirSize(dir string) int64 {
+	return walkSize(filepath.Join(STORAGE, dir), "")
+}
+
+// countSize sets a build's size from its files, and marks it counted so it isn't walked again on reload, even if empty.
+func (b *Build) countSize() {
+	b.Size = dirSize(b.Files)
+	b.SizeCounted = true
+}
+
+// walkSize totals the regular files under root, leaving out the directory skip if given.
+func walkSize(root, skip string) (size int64) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path == skip {
+			return filepath.SkipDir
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// sizeRecounts lists builds whose files were changed in the background, like by precompression. Storage isn't touched from there,
+// so they're recounted by loadAllBuilds, which already writes it in the background.
+type sizeRecounts struct {
+	lock   sync.Mutex
+	builds map[string]bool // map[Build.Files]
+}
+
+func (r *sizeRecounts) add(dir string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.builds == nil {
+		r.builds = map[string]bool{}
+	}
+	r.builds[dir] = true
+}
+
+func (r *sizeRecounts) take() map[string]bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	builds := r.builds
+	r.builds = nil
+	return builds
+}
+
+// recountSizes updates the sizes of builds queued in sizeRecounts. Only to be called from loadAllBuilds.
+func (app *appContext) recountSizes() {
+	dirs := app.recounts.take()
+	if len(dirs) == 0 {
+		return
+	}
+	for _, repo := range app.storage {
+		for commit, build := range repo.Builds {
+			if build.Files != "" && dirs[build.Files] {
+				build.countSize()
+				repo.Builds[commit] = build
+			}
+		}
+	}
+}
+
+// Size returns the total size of all files stored for the repo.
+func (repo Repo) Size() (size int64) {
+	for _, b := range repo.Builds {
+		if b.Files != "" {
+			size += b.Size
+		}
+	}
+	return
+}
+
+type RepoUsageDTO struct {
+	Namespace string
+	Name      string
+	Size      int64
+	Builds    int // Number of builds with files.
+}
+
+type BuildUsageDTO struct {
+	Namespace string
+	Name      string
+	Commit    string
+	Size      int64
+	Date      time.Time
+}
+
+type StorageDTO struct {
+	Used   int64  // Bytes used by build files.
+	Data   int64  // Bytes used by build files plus everything else under the data directory.
+	Free   uint64 // Free bytes on the data directory's filesystem.
+	Total  uint64
+	Repos  []RepoUsageDTO  // Largest first.
+	Builds []BuildUsageDTO // Largest first.
+}
+
+// getStorage summarises disk usage. ?limit sets how many of the largest repos and builds are listed (default 10).
+func (app *appContext) getStorage(gc *gin.Context) {
+	limit, err := strconv.Atoi(gc.DefaultQuery("limit", "10"))
+	if err != nil || limit < 0 {
+		end(400, "Invalid limit", gc)
+		return
+	}
+	resp := StorageDTO{
+		Repos:  []RepoUsageDTO{},
+		Builds: []BuildUsageDTO{},
+	}
+	for _, repo := range app.storage {
+		r := RepoUsageDTO{
+			Namespace: repo.Namespace,
+			Name:      repo.Name,
+		}
+		for commit, b := range repo.Builds {
+			if b.Files == "" {
+				continue
+			}
+			r.Size += b.Size
+			r.Builds++
+			resp.Builds = append(resp.Builds, BuildUsageDTO{
+				Namespace: repo.Namespace,
+				Name:      repo.Name,
+				Commit:    commit,
+				Size:      b.Size,
+				Date:      b.DateChanged,
+			})
+		}
+		resp.Used += r.Size
+		resp.Repos = append(resp.Repos, r)
+	}
+	sort.Slice(resp.Repos, func(i, j int) bool { return resp.Repos[i].Size > resp.Repos[j].Size })
+	sort.Slice(resp.Builds, func(i, j int) bool { return resp.Builds[i].Size > resp.Builds[j].Size })
+	if len(resp.Repos) > limit {
+		resp.Repos = resp.Repos[:limit]
+	}
+	if len(resp.Builds) > limit {
+		resp.Builds = resp.Builds[:limit]
+	}
+	// Build files are already counted, so only the rest of the data directory (storage, stats and snapshots) is walked.
+	resp.Data = resp.Used + walkSize(DATADIR, STORAGE)
+	resp.Free, resp.Total, err = diskSpace(DATADIR)
+	if err != nil {
+		end(500, fmt.Sprintf("Couldn't get disk space: %s", err), gc)
+		return
+	}
+	gc.JSON(200, resp)
+}
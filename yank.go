@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recomputeLatestNonEmpty sets LatestNonEmptyBuild to the newest build with files that isn't yanked.
+func (repo *Repo) recomputeLatestNonEmpty() {
+	repo.LatestNonEmptyBuild = ""
+	var latest Build
+	for commit, b := range repo.Builds {
+		if b.Files == "" || b.Yanked || !b.Date.After(latest.Date) {
+			continue
+		}
+		if buildHasFiles(b) {
+			latest = b
+			repo.LatestNonEmptyBuild = commit
+		}
+	}
+}
+
+type YankReqDTO struct {
+	Reason string
+}
+
+// YankBuild withdraws a build, so it's no longer resolved as latest or for tags and channels.
+func (app *appContext) YankBuild(gc *gin.Context) {
+	var req YankReqDTO
+	if err := gc.BindJSON(&req); err != nil {
+		end(400, fmt.Sprintf("Failed to bind request JSON: %s", err), gc)
+		return
+	}
+	app.setYanked(gc, true, req.Reason)
+}
+
+// UnyankBuild restores a yanked build.
+func (app *appContext) UnyankBuild(gc *gin.Context) {
+	app.setYanked(gc, false, "")
+}
+
+func (app *appContext) setYanked(gc *gin.Context, yanked bool, reason string) {
+	namespace := gc.Param("namespace")
+	name := gc.Param("name")
+	commit := gc.Param("build")
+	repo, ok := app.storage[namespace+"/"+name]
+	if !ok {
+		end(400, fmt.Sprintf("Repository not found: %s/%s", namespace, name), gc)
+		return
+	}
+	build, ok := repo.Builds[commit]
+	if !ok {
+		end(400, "Build not found", gc)
+		return
+	}
+	build.Yanked = yanked
+	build.YankReason = reason
+	repo.Builds[commit] = build
+	repo.recomputeLatestNonEmpty()
+	for tagName := range build.Tags {
+		repo.recomputeLatestTag(tagName)
+	}
+	app.storage[namespace+"/"+name] = repo
+	if err := app.store(); err != nil {
+		end(500, fmt.Sprintf("Couldn't store data: %s", err), gc)
+		return
+	}
+	if yanked {
+		log.Printf("%s/%s: Yanked %s: %s", namespace, name, commit, reason)
+		end(200, "Build yanked", gc)
+	} else {
+		log.Printf("%s/%s: Unyanked %s", namespace, name, commit)
+		end(200, "Build restored", gc)
+	}
+}
+
+// allowYankedDownload applies YANKED_DOWNLOADS to a download from a yanked build, returning false if it was refused.
+func allowYankedDownload(gc *gin.Context, build Build) bool {
+	if !build.Yanked {
+		return true
+	}
+	if YANKED_DOWNLOADS == "block" {
+		end(410, fmt.Sprintf("Build has been yanked: %s", build.YankReason), gc)
+		return false
+	}
+	gc.Header("X-Buildrone-Yanked", build.YankReason)
+	gc.Header("Warning", fmt.Sprintf("299 buildrone %q", "Build has been yanked: "+build.YankReason))
+	return true
+}